@@ -0,0 +1,244 @@
+package iblt
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// the benchmark matrix, item lengths and bucket numbers from a small table
+// to one past what the legacy format indexes, filled to a light and a heavy
+// load
+var (
+	benchDataLens = []int{8, 32}
+	benchBuckets  = []uint{1024, 16384, 1 << 18}
+	benchLoads    = []float64{0.1, 0.5}
+)
+
+type benchCase struct {
+	dataLen int
+	buckets uint
+	// items in the table, or in the difference of two tables
+	items int
+}
+
+func (c benchCase) String() string {
+	return fmt.Sprintf("len=%d/buckets=%d/items=%d", c.dataLen, c.buckets, c.items)
+}
+
+func benchCases() []benchCase {
+	var cases []benchCase
+	for _, dataLen := range benchDataLens {
+		for _, buckets := range benchBuckets {
+			for _, load := range benchLoads {
+				cases = append(cases, benchCase{dataLen, buckets, int(float64(buckets) * load)})
+			}
+		}
+	}
+	return cases
+}
+
+func benchItems(n int, dataLen int) [][]byte {
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = make([]byte, dataLen)
+		rand.Read(items[i])
+	}
+	return items
+}
+
+func benchTable(c benchCase, items [][]byte) *Table {
+	table := NewTable(c.buckets, c.dataLen, 1, 4)
+	for _, item := range items {
+		table.Insert(item)
+	}
+	return table
+}
+
+func BenchmarkTable_Insert(b *testing.B) {
+	for _, c := range benchCases() {
+		items := benchItems(4096, c.dataLen)
+		b.Run(c.String(), func(b *testing.B) {
+			table := benchTable(c, benchItems(c.items, c.dataLen))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				table.Insert(items[n%len(items)])
+			}
+		})
+	}
+}
+
+func BenchmarkTable_Delete(b *testing.B) {
+	for _, c := range benchCases() {
+		items := benchItems(4096, c.dataLen)
+		b.Run(c.String(), func(b *testing.B) {
+			table := benchTable(c, benchItems(c.items, c.dataLen))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				table.Delete(items[n%len(items)])
+			}
+		})
+	}
+}
+
+func BenchmarkTable_Subtract(b *testing.B) {
+	for _, c := range benchCases() {
+		b.Run(c.String(), func(b *testing.B) {
+			alice := benchTable(c, benchItems(c.items, c.dataLen))
+			bob := benchTable(c, benchItems(c.items, c.dataLen))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				// subtracting twice leaves alice as it was
+				alice.Subtract(bob)
+			}
+		})
+	}
+}
+
+func BenchmarkTable_Copy(b *testing.B) {
+	for _, c := range benchCases() {
+		b.Run(c.String(), func(b *testing.B) {
+			table := benchTable(c, benchItems(c.items, c.dataLen))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				table.Copy()
+			}
+		})
+	}
+}
+
+func BenchmarkTable_Serialize(b *testing.B) {
+	for _, c := range benchCases() {
+		b.Run(c.String(), func(b *testing.B) {
+			table := benchTable(c, benchItems(c.items, c.dataLen))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := table.Serialize(); err != nil {
+					b.Fatalf("serialize error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTable_Deserialize(b *testing.B) {
+	for _, c := range benchCases() {
+		b.Run(c.String(), func(b *testing.B) {
+			ser, err := benchTable(c, benchItems(c.items, c.dataLen)).Serialize()
+			if err != nil {
+				b.Fatalf("serialize error: %v", err)
+			}
+			b.SetBytes(int64(len(ser)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := Deserialize(ser); err != nil {
+					b.Fatalf("deserialize error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// two tables sharing items items, their difference of items items split
+// evenly between them
+func BenchmarkTable_Decode(b *testing.B) {
+	for _, c := range benchCases() {
+		b.Run(c.String(), func(b *testing.B) {
+			shared := benchItems(c.items, c.dataLen)
+			alice := benchTable(c, append(shared, benchItems(c.items/2, c.dataLen)...))
+			bob := benchTable(c, append(shared[:len(shared):len(shared)], benchItems(c.items-c.items/2, c.dataLen)...))
+			alice.Subtract(bob)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				cpy := alice.Copy()
+				b.StartTimer()
+				if _, err := cpy.Decode(); err != nil {
+					b.Fatalf("decode error: %v", err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*c.items), "ns/item")
+		})
+	}
+}
+
+var diffSizes = []int{1000, 10000, 100000}
+
+// constant time per item, ns/op should not grow with the size
+func BenchmarkDiff_encode(b *testing.B) {
+	for _, size := range diffSizes {
+		items := make([]*Bucket, size)
+		for i := range items {
+			items[i] = NewBucket(16, 1)
+			rand.Read(items[i].dataSum)
+			items[i].count = 1 - 2*(i%2)
+		}
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				diff := NewDiff(uint(size))
+				for _, item := range items {
+					diff.encode(item)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*size), "ns/item")
+		})
+	}
+}
+
+// decoding time per item should not grow with the difference size
+func BenchmarkTable_DecodeSize(b *testing.B) {
+	for _, size := range diffSizes {
+		table := NewTable(uint(size)*3/2, 16, 1, 4)
+		item := make([]byte, 16)
+		for i := 0; i < size; i++ {
+			rand.Read(item)
+			table.Insert(item)
+		}
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				cpy := table.Copy()
+				b.StartTimer()
+				if _, err := cpy.Decode(); err != nil {
+					b.Fatalf("decode error: %v", err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*size), "ns/item")
+		})
+	}
+}
+
+// decoding is linear in the cells, iterations/cell stays flat. ns/cell still
+// grows once the buckets no longer fit the CPU caches, every peel touches
+// hashNum random buckets, as Insert and Delete do.
+func BenchmarkTable_DecodeCells(b *testing.B) {
+	for _, cells := range []int{10000, 100000, 1000000} {
+		table := NewTable(uint(cells), 16, 1, 4)
+		item := make([]byte, 16)
+		for i := 0; i < cells*2/3; i++ {
+			rand.Read(item)
+			table.Insert(item)
+		}
+		b.Run(strconv.Itoa(cells), func(b *testing.B) {
+			var stats DecodeStats
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				cpy := table.Copy()
+				b.StartTimer()
+				if _, err := cpy.Decode(WithStats(&stats)); err != nil {
+					b.Fatalf("decode error: %v", err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*cells), "ns/cell")
+			b.ReportMetric(float64(stats.Iterations)/float64(cells), "iterations/cell")
+		})
+	}
+}
@@ -0,0 +1,247 @@
+// Package blockrelay relays a block to a peer that already holds most of its
+// transactions, sending a table of short transaction IDs sized by the
+// difference between the block and the peer's mempool instead of the list
+// of every transaction.
+//
+// The sender encodes the block:
+//
+//	cb, err := blockrelay.Encode(block, salt, buckets)
+//
+// the receiver subtracts its mempool and asks for what it misses:
+//
+//	p, err := cb.Reconcile(mempool)
+//	txs, err := blockrelay.Lookup(block, cb.Salt, p.Missing)  // on the sender
+//	err = p.Fill(txs)
+//	block, err := p.Block()
+package blockrelay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/SheldonZhong/go-IBLT"
+)
+
+// TxID identifies a transaction
+type TxID [32]byte
+
+const (
+	// ShortIDLen is the length of the salted short transaction IDs
+	ShortIDLen = 6
+	hashLen    = 1
+	hashNum    = 4
+)
+
+var (
+	// the block has two transactions of the same short ID, encode it again
+	// with another salt
+	ErrShortIDCollision = iblt.ErrShortIDCollision
+
+	// the decoded transactions do not add up to the block
+	ErrTxCount = errors.New("transaction count mismatch")
+
+	// Block was called before every missing transaction was filled
+	ErrMissing = errors.New("missing transactions")
+)
+
+// ShortID is the salted short ID of a transaction, iblt.ShortID of its ID
+func ShortID(id TxID, salt uint64) []byte {
+	// ShortIDLen is in range, cannot fail
+	rtn, _ := iblt.ShortID(id[:], salt, ShortIDLen)
+	return rtn
+}
+
+// CompactBlock is what the sender relays instead of a block
+type CompactBlock struct {
+	Salt    uint64
+	TxCount int
+	// serialized table of the short IDs of the block
+	Table []byte
+	// block position of every transaction in short ID order, nil if the
+	// block is in short ID order
+	Order []uint32
+}
+
+// Encode builds a compact block, buckets sized for the expected difference
+// between the block and the receiver's mempool
+func Encode(block []TxID, salt uint64, buckets uint) (*CompactBlock, error) {
+	table := iblt.NewTable(buckets, ShortIDLen, hashLen, hashNum)
+	short := make([][]byte, len(block))
+	seen := make(map[string]bool, len(block))
+	for i, id := range block {
+		short[i] = ShortID(id, salt)
+		if seen[string(short[i])] {
+			return nil, ErrShortIDCollision
+		}
+		seen[string(short[i])] = true
+		if err := table.Insert(short[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := table.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	cb := &CompactBlock{
+		Salt:    salt,
+		TxCount: len(block),
+		Table:   b,
+	}
+
+	positions := make([]uint32, len(block))
+	for i := range positions {
+		positions[i] = uint32(i)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return bytes.Compare(short[positions[i]], short[positions[j]]) < 0
+	})
+	for i, pos := range positions {
+		if pos != uint32(i) {
+			cb.Order = positions
+			break
+		}
+	}
+
+	return cb, nil
+}
+
+// Partial is a block under reconstruction on the receiver
+type Partial struct {
+	salt  uint64
+	txs   []TxID
+	known []bool
+	short [][]byte
+	// block position by short ID
+	position map[string]int
+
+	// short IDs of the block transactions missing from the mempool, in block
+	// order, to be requested from the sender
+	Missing [][]byte
+	// mempool transactions that are not in the block
+	Extra []TxID
+}
+
+// Reconcile subtracts the mempool from the block and places every known
+// transaction at its block position. Mempool transactions sharing a short ID
+// are left out and fetched from the sender if the block has one of them.
+func (cb CompactBlock) Reconcile(mempool []TxID) (*Partial, error) {
+	remote, err := iblt.Deserialize(cb.Table)
+	if err != nil {
+		return nil, err
+	}
+	if remote.DataLen() != ShortIDLen {
+		return nil, fmt.Errorf("table of %d byte short IDs, want %d", remote.DataLen(), ShortIDLen)
+	}
+
+	byShort := make(map[string]TxID, len(mempool))
+	colliding := make(map[string]bool)
+	for _, id := range mempool {
+		s := string(ShortID(id, cb.Salt))
+		if other, ok := byShort[s]; ok && other != id {
+			colliding[s] = true
+		}
+		byShort[s] = id
+	}
+	for s := range colliding {
+		delete(byShort, s)
+	}
+
+	// deleting the mempool leaves the difference, block transactions on the
+	// alpha side and mempool extras on the beta side
+	for s := range byShort {
+		if err := remote.Delete([]byte(s)); err != nil {
+			return nil, err
+		}
+	}
+	diff, err := remote.Decode()
+	if err != nil {
+		return nil, fmt.Errorf("block and mempool differ too much: %w", err)
+	}
+
+	p := &Partial{salt: cb.Salt}
+	for _, b := range diff.BetaSlice() {
+		p.Extra = append(p.Extra, byShort[string(b)])
+		delete(byShort, string(b))
+	}
+	short := diff.AlphaSlice()
+	for s := range byShort {
+		short = append(short, []byte(s))
+	}
+	if len(short) != cb.TxCount {
+		return nil, ErrTxCount
+	}
+	sort.Slice(short, func(i, j int) bool {
+		return bytes.Compare(short[i], short[j]) < 0
+	})
+
+	p.txs = make([]TxID, cb.TxCount)
+	p.known = make([]bool, cb.TxCount)
+	p.short = make([][]byte, cb.TxCount)
+	p.position = make(map[string]int, cb.TxCount)
+	for i, s := range short {
+		pos := i
+		if cb.Order != nil {
+			if len(cb.Order) != cb.TxCount || int(cb.Order[i]) >= cb.TxCount {
+				return nil, ErrTxCount
+			}
+			pos = int(cb.Order[i])
+		}
+		p.position[string(s)] = pos
+		p.short[pos] = s
+		if id, ok := byShort[string(s)]; ok {
+			p.txs[pos] = id
+			p.known[pos] = true
+		}
+	}
+	for pos, ok := range p.known {
+		if !ok {
+			p.Missing = append(p.Missing, p.short[pos])
+		}
+	}
+
+	return p, nil
+}
+
+// Lookup answers a request for missing transactions on the sender
+func Lookup(block []TxID, salt uint64, short [][]byte) ([]TxID, error) {
+	byShort := make(map[string]TxID, len(block))
+	for _, id := range block {
+		byShort[string(ShortID(id, salt))] = id
+	}
+
+	rtn := make([]TxID, len(short))
+	for i, s := range short {
+		id, ok := byShort[string(s)]
+		if !ok {
+			return nil, fmt.Errorf("no transaction of short ID %x", s)
+		}
+		rtn[i] = id
+	}
+	return rtn, nil
+}
+
+// Fill places fetched transactions, in any order, at their block position
+func (p *Partial) Fill(txs []TxID) error {
+	for _, id := range txs {
+		pos, ok := p.position[string(ShortID(id, p.salt))]
+		if !ok {
+			return fmt.Errorf("transaction %x is not in the block", id)
+		}
+		p.txs[pos] = id
+		p.known[pos] = true
+	}
+	return nil
+}
+
+// Block returns the transactions in block order once none is missing
+func (p *Partial) Block() ([]TxID, error) {
+	for _, ok := range p.known {
+		if !ok {
+			return nil, ErrMissing
+		}
+	}
+	return p.txs, nil
+}
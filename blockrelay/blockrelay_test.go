@@ -0,0 +1,151 @@
+package blockrelay
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SheldonZhong/go-IBLT"
+)
+
+var seedFlag = flag.Int64("seed", 0, "seed of the random tests, 0 picks one from the clock")
+
+// testRand returns the source of random transactions of a test and logs its
+// seed, rerun a failed test with -seed to reproduce it
+func testRand(t testing.TB) *rand.Rand {
+	seed := *seedFlag
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", seed)
+	return rand.New(rand.NewSource(seed))
+}
+
+func randomTxs(r *rand.Rand, n int) []TxID {
+	txs := make([]TxID, n)
+	for i := range txs {
+		r.Read(txs[i][:])
+	}
+	return txs
+}
+
+func TestRelay(t *testing.T) {
+	r := testRand(t)
+
+	block := randomTxs(r, 2000)
+	// the receiver misses a few block transactions and holds a few others
+	mempool := append([]TxID{}, block[25:]...)
+	mempool = append(mempool, randomTxs(r, 15)...)
+	r.Shuffle(len(mempool), func(i, j int) {
+		mempool[i], mempool[j] = mempool[j], mempool[i]
+	})
+
+	salt := r.Uint64()
+	cb, err := Encode(block, salt, 128)
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	if cb.Order == nil {
+		t.Error("random block encoded without order")
+	}
+
+	p, err := cb.Reconcile(mempool)
+	if err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	if len(p.Missing) != 25 || len(p.Extra) != 15 {
+		t.Fatalf("missing/extra want 25/15, get %d/%d", len(p.Missing), len(p.Extra))
+	}
+	if _, err := p.Block(); !errors.Is(err, ErrMissing) {
+		t.Errorf("block error want %v, get %v", ErrMissing, err)
+	}
+
+	txs, err := Lookup(block, cb.Salt, p.Missing)
+	if err != nil {
+		t.Fatalf("lookup error: %v", err)
+	}
+	if !reflect.DeepEqual(txs, block[:25]) {
+		t.Error("missing transactions are not requested in block order")
+	}
+	if err := p.Fill(randomTxs(r, 1)); err == nil {
+		t.Error("filled a transaction outside the block")
+	}
+	if err := p.Fill(txs); err != nil {
+		t.Fatalf("fill error: %v", err)
+	}
+	got, err := p.Block()
+	if err != nil {
+		t.Fatalf("block error: %v", err)
+	}
+	if !reflect.DeepEqual(got, block) {
+		t.Error("reconstructed block mismatches")
+	}
+}
+
+func TestRelay_Duplicate(t *testing.T) {
+	r := testRand(t)
+
+	block := randomTxs(r, 100)
+	salt := r.Uint64()
+	if _, err := Encode(append(block, block[3]), salt, 64); !errors.Is(err, ErrShortIDCollision) {
+		t.Errorf("encode error want %v, get %v", ErrShortIDCollision, err)
+	}
+
+	// a transaction listed twice in the mempool is still one transaction
+	cb, err := Encode(block, salt, 64)
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	p, err := cb.Reconcile(append(block, block[3]))
+	if err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	got, err := p.Block()
+	if err != nil {
+		t.Fatalf("block error: %v", err)
+	}
+	if !reflect.DeepEqual(got, block) {
+		t.Error("reconstructed block mismatches")
+	}
+}
+
+func TestRelay_TooDifferent(t *testing.T) {
+	r := testRand(t)
+
+	block := randomTxs(r, 500)
+	cb, err := Encode(block, r.Uint64(), 16)
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	if _, err := cb.Reconcile(randomTxs(r, 500)); err == nil {
+		t.Error("reconciled a mempool sharing nothing with the block")
+	}
+}
+
+func TestRelay_ShortIDLen(t *testing.T) {
+	// a table of 7 byte short IDs from a peer of other parameters
+	table := iblt.NewTable(16, ShortIDLen+1, hashLen, hashNum)
+	b, err := table.Serialize()
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	cb := &CompactBlock{Salt: 1, Table: b}
+	if _, err := cb.Reconcile(nil); err == nil {
+		t.Error("reconciled a table of another short ID length")
+	}
+}
+
+func TestShortID(t *testing.T) {
+	r := testRand(t)
+
+	id := randomTxs(r, 1)[0]
+	salt := r.Uint64()
+	want, _ := iblt.ShortID(id[:], salt, ShortIDLen)
+	if got := ShortID(id, salt); !bytes.Equal(got, want) {
+		t.Errorf("short ID want %x, get %x", want, got)
+	}
+}
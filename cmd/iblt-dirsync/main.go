@@ -0,0 +1,160 @@
+// Command iblt-dirsync finds the files that differ between two directory
+// trees while exchanging a table sized by the difference rather than by the
+// trees.
+//
+// One side serves its tree, over TCP or over stdin and stdout:
+//
+//	iblt-dirsync serve -listen :7070 /srv/data
+//
+// the other side syncs against it and reports the differing files:
+//
+//	iblt-dirsync sync -connect host:7070 /backup/data
+//	iblt-dirsync sync -exec 'ssh host iblt-dirsync serve /srv/data' /backup/data
+//
+// Files only the peer has are printed as '+ path', files only the local tree
+// has as '- path' and files whose content differs as 'M path'.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = runServe(os.Args[2:])
+	case "sync":
+		err = runSync(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "iblt-dirsync %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: iblt-dirsync serve [-listen addr] dir")
+	fmt.Fprintln(os.Stderr, "       iblt-dirsync sync (-connect addr | -exec command) [flags] dir")
+	os.Exit(2)
+}
+
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "", "TCP address to listen on, stdin and stdout when empty")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	root := fs.Arg(0)
+
+	if *listen == "" {
+		files, err := scan(root)
+		if err != nil {
+			return err
+		}
+		return serve(stdio{os.Stdin, os.Stdout}, files)
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		// rescan for every peer, the tree may have changed in between
+		go func() {
+			defer conn.Close()
+			files, err := scan(root)
+			if err == nil {
+				err = serve(conn, files)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "iblt-dirsync serve: %s: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	connect := fs.String("connect", "", "TCP address of a serving peer")
+	command := fs.String("exec", "", "shell command that serves the peer tree on its stdin and stdout")
+	buckets := fs.Uint("buckets", 1024, "initial number of buckets")
+	hashNum := fs.Int("hashnum", 4, "number of hash functions")
+	retries := fs.Int("retries", 6, "times to double the buckets when the difference does not decode")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*connect == "") == (*command == "") {
+		usage()
+	}
+
+	files, err := scan(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var rep *report
+	if *connect != "" {
+		conn, err := net.Dial("tcp", *connect)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if rep, err = reconcile(conn, files, *buckets, *hashNum, *retries); err != nil {
+			return err
+		}
+	} else {
+		cmd := exec.Command("sh", "-c", *command)
+		cmd.Stderr = os.Stderr
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		rep, err = reconcile(stdio{out, in}, files, *buckets, *hashNum, *retries)
+		in.Close()
+		if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+			err = waitErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range rep.added {
+		fmt.Printf("+ %s\n", name)
+	}
+	for _, name := range rep.removed {
+		fmt.Printf("- %s\n", name)
+	}
+	for _, name := range rep.modified {
+		fmt.Printf("M %s\n", name)
+	}
+	return nil
+}
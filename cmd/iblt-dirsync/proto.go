@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/SheldonZhong/go-IBLT"
+)
+
+// Every message is a frame of one type byte, a 32 bit big endian payload
+// length and the payload. The syncing side drives the exchange:
+//
+//	sync  -> serve  params  buckets and hash functions, both uint16
+//	serve -> sync   table   serialized table of the served tree
+//	sync  -> serve  query   concatenated items only the served tree has
+//	serve -> sync   names   NUL separated paths of the queried items
+//
+// params may be sent again with more buckets when decoding fails.
+const (
+	frameParams = 'P'
+	frameTable  = 'T'
+	frameQuery  = 'Q'
+	frameNames  = 'N'
+	frameError  = 'E'
+)
+
+const (
+	maxFrame   = 64 << 20
+	maxBuckets = 1<<16 - 1
+)
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds limit", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// expect reads the next frame and fails unless it is of type typ
+func expect(r io.Reader, typ byte) ([]byte, error) {
+	got, payload, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if got == frameError {
+		return nil, fmt.Errorf("peer: %s", payload)
+	}
+	if got != typ {
+		return nil, fmt.Errorf("unexpected frame %q, want %q", got, typ)
+	}
+	return payload, nil
+}
+
+func checkParams(buckets uint, hashNum int) error {
+	if buckets == 0 || buckets > maxBuckets {
+		return fmt.Errorf("buckets must be between 1 and %d", maxBuckets)
+	}
+	if hashNum <= 0 || uint(hashNum) > buckets {
+		return errors.New("hash functions must be between 1 and the number of buckets")
+	}
+	return nil
+}
+
+func buildTable(files map[item]string, buckets uint, hashNum int) (*iblt.Table, error) {
+	table := iblt.NewTable(buckets, itemLen, 1, hashNum)
+	for it := range files {
+		if err := table.Insert(it[:]); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+// serve answers one syncing peer until it closes the connection
+func serve(rw io.ReadWriter, files map[item]string) error {
+	w := bufio.NewWriter(rw)
+	fail := func(err error) error {
+		writeFrame(w, frameError, []byte(err.Error()))
+		w.Flush()
+		return err
+	}
+
+	for {
+		typ, payload, err := readFrame(rw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameParams:
+			if len(payload) != 4 {
+				return fail(errors.New("malformed params"))
+			}
+			buckets := uint(binary.BigEndian.Uint16(payload))
+			hashNum := int(binary.BigEndian.Uint16(payload[2:]))
+			if err := checkParams(buckets, hashNum); err != nil {
+				return fail(err)
+			}
+			table, err := buildTable(files, buckets, hashNum)
+			if err != nil {
+				return fail(err)
+			}
+			b, err := table.Serialize()
+			if err != nil {
+				return fail(err)
+			}
+			err = writeFrame(w, frameTable, b)
+		case frameQuery:
+			if len(payload)%itemLen != 0 {
+				return fail(errors.New("malformed query"))
+			}
+			names := make([][]byte, 0, len(payload)/itemLen)
+			for off := 0; off < len(payload); off += itemLen {
+				var it item
+				copy(it[:], payload[off:])
+				names = append(names, []byte(files[it]))
+			}
+			err = writeFrame(w, frameNames, bytes.Join(names, []byte{0}))
+		default:
+			return fail(fmt.Errorf("unexpected frame %q", typ))
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+type report struct {
+	// relative to the local tree: files only the peer has, files only the
+	// local tree has, and files whose content differs
+	added    []string
+	removed  []string
+	modified []string
+}
+
+// reconcile fetches the peer's table, starting at buckets and doubling on
+// every failed decode, and resolves the differing files to paths
+func reconcile(rw io.ReadWriter, files map[item]string, buckets uint, hashNum int, retries int) (*report, error) {
+	var diff *iblt.Diff
+	for attempt := 0; ; attempt++ {
+		if err := checkParams(buckets, hashNum); err != nil {
+			return nil, err
+		}
+		params := make([]byte, 4)
+		binary.BigEndian.PutUint16(params, uint16(buckets))
+		binary.BigEndian.PutUint16(params[2:], uint16(hashNum))
+		if err := writeFrame(rw, frameParams, params); err != nil {
+			return nil, err
+		}
+		payload, err := expect(rw, frameTable)
+		if err != nil {
+			return nil, err
+		}
+		remote, err := iblt.Deserialize(payload)
+		if err != nil {
+			return nil, err
+		}
+		local, err := buildTable(files, buckets, hashNum)
+		if err != nil {
+			return nil, err
+		}
+		if err := local.Subtract(remote); err != nil {
+			return nil, err
+		}
+		// a 1 byte checksum lets foreign buckets peel now and then, verify
+		// the difference and, like a stalled peel, ask for more buckets
+		// when it does not add up
+		diff, err = local.Decode(iblt.WithVerify())
+		if err == nil {
+			break
+		}
+		if attempt == retries || buckets == maxBuckets {
+			return nil, fmt.Errorf("difference too large to decode with %d buckets: %v", buckets, err)
+		}
+		buckets *= 2
+		if buckets > maxBuckets {
+			buckets = maxBuckets
+		}
+	}
+
+	remoteOnly := diff.BetaSlice()
+	var query []byte
+	for _, it := range remoteOnly {
+		query = append(query, it...)
+	}
+	var names [][]byte
+	if len(remoteOnly) > 0 {
+		if err := writeFrame(rw, frameQuery, query); err != nil {
+			return nil, err
+		}
+		payload, err := expect(rw, frameNames)
+		if err != nil {
+			return nil, err
+		}
+		names = bytes.Split(payload, []byte{0})
+		if len(names) != len(remoteOnly) {
+			return nil, fmt.Errorf("peer named %d files, want %d", len(names), len(remoteOnly))
+		}
+	}
+
+	theirs := make(map[[pathLen]byte]string)
+	for i, b := range remoteOnly {
+		var it item
+		copy(it[:], b)
+		theirs[it.pathKey()] = string(names[i])
+	}
+
+	rep := &report{}
+	for _, b := range diff.AlphaSlice() {
+		var it item
+		copy(it[:], b)
+		if _, ok := theirs[it.pathKey()]; ok {
+			rep.modified = append(rep.modified, files[it])
+			delete(theirs, it.pathKey())
+		} else {
+			rep.removed = append(rep.removed, files[it])
+		}
+	}
+	for _, name := range theirs {
+		rep.added = append(rep.added, name)
+	}
+
+	sort.Strings(rep.added)
+	sort.Strings(rep.removed)
+	sort.Strings(rep.modified)
+	return rep, nil
+}
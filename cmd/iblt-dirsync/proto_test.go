@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTree(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestReconcile(t *testing.T) {
+	shared := map[string]string{}
+	for i := 0; i < 200; i++ {
+		shared[filepath.ToSlash(filepath.Join("shared", string(rune('a'+i%26)), string(rune('a'+i/26))))] = "same"
+	}
+	local := map[string]string{"only/local": "x", "docs/readme": "old"}
+	remote := map[string]string{"only/remote": "y", "docs/readme": "new", "nested/dir/file": "z"}
+	for name, content := range shared {
+		local[name] = content
+		remote[name] = content
+	}
+
+	localFiles, err := scan(writeTree(t, local))
+	if err != nil {
+		t.Fatalf("scan local error: %v", err)
+	}
+	remoteFiles, err := scan(writeTree(t, remote))
+	if err != nil {
+		t.Fatalf("scan remote error: %v", err)
+	}
+
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		done <- serve(server, remoteFiles)
+	}()
+
+	// start too small so that at least one retry with more buckets happens
+	rep, err := reconcile(client, localFiles, 4, 4, 6)
+	client.Close()
+	if err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("serve error: %v", err)
+	}
+
+	if want := []string{"nested/dir/file", "only/remote"}; !reflect.DeepEqual(rep.added, want) {
+		t.Errorf("added want %v, get %v", want, rep.added)
+	}
+	if want := []string{"only/local"}; !reflect.DeepEqual(rep.removed, want) {
+		t.Errorf("removed want %v, get %v", want, rep.removed)
+	}
+	if want := []string{"docs/readme"}; !reflect.DeepEqual(rep.modified, want) {
+		t.Errorf("modified want %v, get %v", want, rep.modified)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// each file is one item: a path hash followed by a content hash, so a
+	// modified file shows up on both sides of the difference with the same
+	// path prefix
+	pathLen    = 8
+	contentLen = 8
+	itemLen    = pathLen + contentLen
+)
+
+type item [itemLen]byte
+
+func (it item) pathKey() [pathLen]byte {
+	var k [pathLen]byte
+	copy(k[:], it[:pathLen])
+	return k
+}
+
+func newItem(path string, content io.Reader) (item, error) {
+	var it item
+	p := sha256.Sum256([]byte(path))
+	copy(it[:pathLen], p[:])
+
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return it, err
+	}
+	copy(it[pathLen:], h.Sum(nil))
+	return it, nil
+}
+
+// scan hashes every regular file under root, keyed by item with the slash
+// separated relative path as value
+func scan(root string) (map[item]string, error) {
+	files := make(map[item]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		it, err := newItem(rel, f)
+		if err != nil {
+			return err
+		}
+		files[it] = rel
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
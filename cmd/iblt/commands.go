@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/SheldonZhong/go-IBLT"
+	"github.com/SheldonZhong/go-IBLT/simulate"
+)
+
+// the serialized header and bucket indexes are 32 bits wide
+const maxBuckets = math.MaxUint32
+
+// checksums are cut from one 64 bit SipHash
+const maxHashLen = 8
+
+func runBuild(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	buckets := fs.Uint("buckets", 1024, "number of buckets")
+	dataLen := fs.Int("len", 16, "record length in bytes, shorter lines are zero padded")
+	hashLen := fs.Int("hashlen", 1, "checksum length in bytes")
+	hashNum := fs.Int("hashnum", 4, "number of hash functions")
+	fixed := fs.Bool("fixed", false, "read back to back records of -len bytes instead of lines")
+	codec := fs.String("codec", "", "compress the buckets with flate, gzip or zlib")
+	output := fs.String("o", "-", "output file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: iblt build [flags] [file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *buckets == 0 || *buckets > maxBuckets {
+		return fmt.Errorf("buckets must be between 1 and %d", maxBuckets)
+	}
+	if *dataLen <= 0 || *hashLen <= 0 || *hashNum <= 0 {
+		return errors.New("len, hashlen and hashnum must be positive")
+	}
+	if *hashLen > maxHashLen {
+		return fmt.Errorf("hashlen must be between 1 and %d", maxHashLen)
+	}
+	if uint(*hashNum) > *buckets {
+		return errors.New("hashnum must not exceed buckets")
+	}
+	var opts []iblt.SerializeOption
+	switch *codec {
+	case "":
+	case "flate":
+		opts = append(opts, iblt.WithCodec(iblt.Flate))
+	case "gzip":
+		opts = append(opts, iblt.WithCodec(iblt.Gzip))
+	case "zlib":
+		opts = append(opts, iblt.WithCodec(iblt.Zlib))
+	default:
+		return fmt.Errorf("unknown codec %q", *codec)
+	}
+
+	input := "-"
+	if fs.NArg() == 1 {
+		input = fs.Arg(0)
+	}
+	in, err := openInput(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var records [][]byte
+	if *fixed {
+		records, err = readFixed(in, *dataLen)
+	} else {
+		records, err = readLines(in, *dataLen)
+	}
+	if err != nil {
+		return err
+	}
+
+	table := iblt.NewTable(*buckets, *dataLen, *hashLen, *hashNum)
+	for _, r := range unique(records) {
+		if err := table.Insert(r); err != nil {
+			return err
+		}
+	}
+
+	b, err := table.Serialize(opts...)
+	if err != nil {
+		return err
+	}
+	out, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(b); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func readTable(name string) (*iblt.Table, error) {
+	in, err := openInput(name)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	return iblt.Deserialize(b)
+}
+
+func runSubtract(args []string) error {
+	fs := flag.NewFlagSet("subtract", flag.ExitOnError)
+	asHex := fs.Bool("hex", false, "print records as hex instead of text")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: iblt subtract [flags] a.iblt b.iblt")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "records only in a are printed as '< record', records only in b as '> record'")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	a, err := readTable(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	b, err := readTable(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(1), err)
+	}
+	if err := a.Subtract(b); err != nil {
+		return err
+	}
+
+	// print whatever was recovered even if decoding fails half way
+	diff, decodeErr := a.Decode()
+	for _, r := range diff.AlphaSlice() {
+		fmt.Printf("< %s\n", formatRecord(r, *asHex))
+	}
+	for _, r := range diff.BetaSlice() {
+		fmt.Printf("> %s\n", formatRecord(r, *asHex))
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("decode incomplete after %d records, table too small for the difference: %v",
+			diff.AlphaLen()+diff.BetaLen(), decodeErr)
+	}
+
+	return nil
+}
+
+// overhead is the ratio of buckets to items above which decoding large
+// differences succeeds reliably, by number of hash functions. Small
+// differences peel less predictably and get a constant margin on top.
+var overhead = map[int]float64{
+	3: 1.50,
+	4: 1.50,
+	5: 1.65,
+	6: 1.80,
+}
+
+const margin = 20
+
+func runEstimate(args []string) error {
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	diff := fs.Int("diff", 100, "expected number of records in the symmetric difference")
+	dataLen := fs.Int("len", 16, "record length in bytes")
+	hashLen := fs.Int("hashlen", 1, "checksum length in bytes")
+	hashNum := fs.Int("hashnum", 4, "number of hash functions")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: iblt estimate [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *diff <= 0 || *dataLen <= 0 || *hashLen <= 0 {
+		return errors.New("diff, len and hashlen must be positive")
+	}
+	if *hashLen > maxHashLen {
+		return fmt.Errorf("hashlen must be between 1 and %d", maxHashLen)
+	}
+	ratio, ok := overhead[*hashNum]
+	if !ok {
+		return fmt.Errorf("no estimate for %d hash functions, use 3 to 6", *hashNum)
+	}
+
+	buckets := uint(math.Ceil(float64(*diff)*ratio)) + margin
+	// the frame header and checksum, then at worst an occupancy bitmap and
+	// every bucket occupied with a one byte count, data and checksum
+	size := 22 + 4 + (int(buckets)+7)/8 + int(buckets)*(1+*dataLen+*hashLen)
+
+	fmt.Printf("buckets:  %d\n", buckets)
+	fmt.Printf("hashnum:  %d\n", *hashNum)
+	fmt.Printf("max size: %d bytes\n", size)
+	if buckets > maxBuckets {
+		fmt.Printf("warning: more than %d buckets cannot be serialized, split the records\n", maxBuckets)
+	}
+
+	return nil
+}
+
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	asBase64 := fs.Bool("base64", false, "print bucket sums as base64 instead of hex")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: iblt inspect [flags] [table.iblt]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	input := "-"
+	if fs.NArg() == 1 {
+		input = fs.Arg(0)
+	}
+	in, err := openInput(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	var encode func([]byte) string
+	if *asBase64 {
+		encode = base64.StdEncoding.EncodeToString
+	}
+	return iblt.DumpSerialized(os.Stdout, b, encode)
+}
+
+func runSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	buckets := fs.Uint("buckets", 1024, "number of buckets")
+	dataLen := fs.Int("len", 16, "record length in bytes")
+	hashLen := fs.Int("hashlen", 1, "checksum length in bytes")
+	hashNum := fs.Int("hashnum", 4, "number of hash functions")
+	alpha := fs.Int("alpha", 300, "records only in the first set")
+	beta := fs.Int("beta", 300, "records only in the second set")
+	shared := fs.Int("shared", 1000, "records in both sets")
+	trials := fs.Int("trials", 1000, "number of trials")
+	seed := fs.Int64("seed", 0, "seed of the first trial, 0 picks one from the clock")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: iblt simulate [flags]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "trial n draws its records from seed+n, rerun a failed trial with -seed and -trials 1")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 || *trials <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *hashLen <= 0 || *hashLen > maxHashLen {
+		return fmt.Errorf("hashlen must be between 1 and %d", maxHashLen)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	p := simulate.Params{
+		Buckets: *buckets,
+		DataLen: *dataLen,
+		HashLen: *hashLen,
+		HashNum: *hashNum,
+		Alpha:   *alpha,
+		Beta:    *beta,
+		Shared:  *shared,
+	}
+	res, err := simulate.Run(p, *seed, *trials)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("seed %d, %d trials\n", res.Seed, res.Trials)
+	fmt.Printf("decoded %d (%.2f%%), failed %d, wrong %d\n",
+		res.Decoded, 100*res.SuccessRate(), res.Failed, res.Wrong)
+	fmt.Printf("collisions in %d trials (%.2f%%), %d items backed out\n",
+		res.CollisionTrials, 100*res.CollisionRate(), res.Collisions)
+	fmt.Printf("mean decode time %v\n", res.MeanDecodeTime())
+	if len(res.FailedSeeds) > 0 {
+		fmt.Printf("failed seeds %v\n", res.FailedSeeds)
+	}
+	return nil
+}
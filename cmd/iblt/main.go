@@ -0,0 +1,59 @@
+// Command iblt builds, subtracts and decodes Invertible Bloom Lookup Tables
+// from record files, so two exports can be reconciled from the shell.
+//
+//	iblt build -buckets 1024 -len 16 alice.txt > alice.iblt
+//	iblt build -buckets 1024 -len 16 bob.txt > bob.iblt
+//	iblt subtract alice.iblt bob.iblt
+//	iblt inspect bob.iblt
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"build", "build a serialized table from a record file", runBuild},
+	{"subtract", "subtract two serialized tables and print the decoded difference", runSubtract},
+	{"estimate", "suggest table parameters for an expected difference size", runEstimate},
+	{"inspect", "print the format, header, statistics and buckets of a serialized table", runInspect},
+	{"simulate", "measure how often tables of given parameters decode a difference", runSimulate},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: iblt <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "run 'iblt <command> -h' for the flags of a command")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "iblt %s: %v\n", c.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "iblt: unknown command %q\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// open a named file, "-" stands for stdin
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// create a named file, "-" stands for stdout
+func createOutput(name string) (io.WriteCloser, error) {
+	if name == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(name)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// readLines reads one record per line, each padded with zero bytes to width.
+// Blank lines are skipped and a trailing carriage return is dropped.
+func readLines(r io.Reader, width int) ([][]byte, error) {
+	var records [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if len(text) == 0 {
+			continue
+		}
+		if len(text) > width {
+			return nil, fmt.Errorf("line %d is %d bytes, longer than record length %d", line, len(text), width)
+		}
+		record := make([]byte, width)
+		copy(record, text)
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// readFixed reads back to back records of exactly width bytes
+func readFixed(r io.Reader, width int) ([][]byte, error) {
+	var records [][]byte
+	reader := bufio.NewReader(r)
+	for {
+		record := make([]byte, width)
+		n, err := io.ReadFull(reader, record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("trailing partial record of %d bytes after %d records", n, len(records))
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// unique drops repeated records, a table holds a set rather than a multiset
+func unique(records [][]byte) [][]byte {
+	seen := make(map[string]bool, len(records))
+	rtn := records[:0]
+	for _, r := range records {
+		if !seen[string(r)] {
+			seen[string(r)] = true
+			rtn = append(rtn, r)
+		}
+	}
+	return rtn
+}
+
+// formatRecord prints a record as text without its zero padding, or as hex
+func formatRecord(b []byte, asHex bool) string {
+	if asHex {
+		return hex.EncodeToString(b)
+	}
+	return string(bytes.TrimRight(b, "\x00"))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadLines(t *testing.T) {
+	records, err := readLines(strings.NewReader("apple\r\n\nfig\nbanana\n"), 6)
+	if err != nil {
+		t.Fatalf("read lines error: %v", err)
+	}
+	want := [][]byte{
+		[]byte("apple\x00"),
+		[]byte("fig\x00\x00\x00"),
+		[]byte("banana"),
+	}
+	if len(records) != len(want) {
+		t.Fatalf("record number mismatch want %d, get %d", len(want), len(records))
+	}
+	for i := range want {
+		if !bytes.Equal(records[i], want[i]) {
+			t.Errorf("record %d mismatch want %q, get %q", i, want[i], records[i])
+		}
+	}
+
+	if _, err := readLines(strings.NewReader("apple\nblueberry\n"), 6); err == nil {
+		t.Error("over long line should fail")
+	}
+}
+
+func TestReadFixed(t *testing.T) {
+	records, err := readFixed(strings.NewReader("aaaabbbbcccc"), 4)
+	if err != nil {
+		t.Fatalf("read fixed error: %v", err)
+	}
+	if len(records) != 3 || string(records[2]) != "cccc" {
+		t.Errorf("unexpected records %q", records)
+	}
+
+	if _, err := readFixed(strings.NewReader("aaaabb"), 4); err == nil {
+		t.Error("partial record should fail")
+	}
+}
+
+func TestUniqueAndFormat(t *testing.T) {
+	records := unique([][]byte{[]byte("a\x00"), []byte("b\x00"), []byte("a\x00")})
+	if len(records) != 2 {
+		t.Fatalf("duplicates remained %q", records)
+	}
+	if s := formatRecord(records[0], false); s != "a" {
+		t.Errorf("text format want %q, get %q", "a", s)
+	}
+	if s := formatRecord(records[1], true); s != "6200" {
+		t.Errorf("hex format want %q, get %q", "6200", s)
+	}
+}
@@ -0,0 +1,252 @@
+package iblt
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// Codec compresses the cells of a serialized table. Its ID is written into
+// the table so Deserialize can find the codec again, see RegisterCodec.
+type Codec interface {
+	// IDs below 128 are kept for the codecs of this package, 0 for cells
+	// that are not compressed
+	ID() byte
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs of the standard library at their default compression level
+var (
+	Flate Codec = stdCodec{1, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}, func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	}}
+	Gzip Codec = stdCodec{2, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	}, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	}}
+	Zlib Codec = stdCodec{3, func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	}, zlib.NewReader}
+)
+
+type stdCodec struct {
+	id        byte
+	newWriter func(io.Writer) (io.WriteCloser, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+func (c stdCodec) ID() byte {
+	return c.id
+}
+
+func (c stdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return c.newWriter(w)
+}
+
+func (c stdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return c.newReader(r)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		Flate.ID(): Flate,
+		Gzip.ID():  Gzip,
+		Zlib.ID():  Zlib,
+	}
+)
+
+// first codec ID open to RegisterCodec
+const minCodecID = 128
+
+// RegisterCodec makes c known to Deserialize. It panics if the ID of c is
+// below 128 or taken by another codec.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c.ID() < minCodecID {
+		panic(fmt.Sprintf("iblt: codec ID %d is reserved, register IDs from %d", c.ID(), minCodecID))
+	}
+	if _, dup := codecs[c.ID()]; dup {
+		panic(fmt.Sprintf("iblt: codec ID %d registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+func lookupCodec(id byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	return c, ok
+}
+
+// SerializeOption tunes a single call to Serialize.
+type SerializeOption func(*serializeConfig)
+
+type serializeConfig struct {
+	columnar bool
+	codec    Codec
+}
+
+// WithColumns writes the cells column by column, the occupancy bitmap,
+// then the counts, the checksums and the data sums of the non-empty
+// buckets. Small counts and short checksums then sit next to each other,
+// which is what a codec compresses well.
+func WithColumns() SerializeOption {
+	return func(c *serializeConfig) {
+		c.columnar = true
+	}
+}
+
+// WithCodec writes the cells in columns, as WithColumns, compressed by c.
+// Serialize then fails for tables of more than 2^24 buckets.
+func WithCodec(c Codec) SerializeOption {
+	return func(cfg *serializeConfig) {
+		cfg.columnar = true
+		cfg.codec = c
+	}
+}
+
+// columnarCells writes the cells of t in columns, prefixed by the codec ID,
+// 0 if they are not compressed
+func (t Table) columnarCells(codec Codec) ([]byte, error) {
+	size := (len(t.buckets) + 7) / 8
+	bitmap := make([]byte, size)
+	var counts, hashSums, dataSums []byte
+	for idx, bkt := range t.buckets {
+		if bkt == nil || bkt.empty() {
+			continue
+		}
+		bitmap[idx/8] |= 0x80 >> (idx % 8)
+		counts = binary.AppendVarint(counts, int64(bkt.count))
+		hashSums = append(hashSums, bkt.hashSum...)
+		dataSums = append(dataSums, bkt.dataSum...)
+	}
+
+	if codec == nil {
+		rtn := make([]byte, 0, 1+size+len(counts)+len(hashSums)+len(dataSums))
+		rtn = append(rtn, 0)
+		rtn = append(rtn, bitmap...)
+		rtn = append(rtn, counts...)
+		rtn = append(rtn, hashSums...)
+		return append(rtn, dataSums...), nil
+	}
+
+	if codec.ID() == 0 {
+		return nil, errors.New("codec ID 0 is reserved")
+	}
+	buffer := bytes.NewBuffer([]byte{codec.ID()})
+	w, err := codec.NewWriter(buffer)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range [][]byte{bitmap, counts, hashSums, dataSums} {
+		if _, err := w.Write(column); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// the largest ratio DEFLATE inflates its input by. Random checksums keep
+// genuine columns far below it whatever the codec.
+const maxInflation = 1032
+
+// readColumnarCells fills the empty table t with what columnarCells wrote
+func (t *Table) readColumnarCells(b []byte) error {
+	if len(b) == 0 {
+		return ErrCorrupt
+	}
+	id, b := b[0], b[1:]
+	if id != 0 {
+		codec, ok := lookupCodec(id)
+		if !ok {
+			return fmt.Errorf("%w: codec %d", ErrUnsupportedFormat, id)
+		}
+		r, err := codec.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		defer r.Close()
+		bitmap := make([]byte, (len(t.buckets)+7)/8)
+		if _, err := io.ReadFull(r, bitmap); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		occupied := 0
+		for _, x := range bitmap {
+			occupied += bits.OnesCount8(x)
+		}
+		// the other columns hold no more than the longest counts and the
+		// sums of the occupied buckets, and inflate no more than DEFLATE
+		// can, stop there rather than inflate a crafted payload
+		hashLen := (t.hashBits + 7) / 8
+		limit := int64(occupied) * int64(binary.MaxVarintLen64+t.dataLen+hashLen)
+		if bound := maxInflation * int64(len(b)); limit > bound {
+			limit = bound
+		}
+		columns, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		if int64(len(columns)) > limit {
+			return ErrCorrupt
+		}
+		b = append(bitmap, columns...)
+	}
+
+	size := (len(t.buckets) + 7) / 8
+	if len(b) < size {
+		return ErrCorrupt
+	}
+	bitmap, b := b[:size], b[size:]
+	if r := len(t.buckets) % 8; r != 0 && bitmap[size-1]<<r != 0 {
+		// bits past the last bucket
+		return ErrCorrupt
+	}
+
+	var occupied []int
+	for idx := range t.buckets {
+		if bitmap[idx/8]&(0x80>>(idx%8)) != 0 {
+			occupied = append(occupied, idx)
+		}
+	}
+	for _, idx := range occupied {
+		count, n := binary.Varint(b)
+		if n <= 0 {
+			return ErrCorrupt
+		}
+		b = b[n:]
+		bkt := t.newBucket()
+		bkt.count = int(count)
+		bkt.wrap()
+		t.buckets[idx] = bkt
+	}
+
+	hashLen := (t.hashBits + 7) / 8
+	if len(b) != len(occupied)*(hashLen+t.dataLen) {
+		return ErrCorrupt
+	}
+	for _, idx := range occupied {
+		copy(t.buckets[idx].hashSum, b[:hashLen])
+		b = b[hashLen:]
+	}
+	for _, idx := range occupied {
+		copy(t.buckets[idx].dataSum, b[:t.dataLen])
+		b = b[t.dataLen:]
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package iblt
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+func compressTable(t *testing.T) *Table {
+	table := NewTable(16384, 4, 1, 3)
+	r := testRand(t)
+	b := make([]byte, 4)
+	for i := 0; i < 2000; i++ {
+		r.Read(b)
+		table.Insert(b)
+	}
+	return table
+}
+
+func TestSerializeCodec(t *testing.T) {
+	table := compressTable(t)
+	columns, err := table.Serialize(WithColumns())
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	if got, err := Deserialize(columns); err != nil || !table.equal(got) {
+		t.Errorf("columns mismatch, error %v", err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		codec Codec
+	}{
+		{"flate", Flate},
+		{"gzip", Gzip},
+		{"zlib", Zlib},
+	} {
+		ser, err := table.Serialize(WithCodec(c.codec))
+		if err != nil {
+			t.Fatalf("%s: serialize error: %v", c.name, err)
+		}
+		if len(ser) >= len(columns) {
+			t.Errorf("%s: compressed to %d bytes, uncompressed %d", c.name, len(ser), len(columns))
+		}
+		got, err := Deserialize(ser)
+		if err != nil {
+			t.Fatalf("%s: deserialize error: %v", c.name, err)
+		}
+		if !table.equal(got) {
+			t.Errorf("%s: deserialized table mismatches", c.name)
+		}
+	}
+
+	packed, _ := NewPackedTable(100, 8, 5, 3, 3)
+	packed.Insert([]byte("abcdefgh"))
+	packed.Delete([]byte("12345678"))
+	ser, err := packed.Serialize(WithCodec(Zlib))
+	if err != nil {
+		t.Fatalf("packed serialize error: %v", err)
+	}
+	if got, err := Deserialize(ser); err != nil || !packed.equal(got) {
+		t.Errorf("packed table mismatches, error %v", err)
+	}
+}
+
+// identity copies the cells as they are
+type identity struct{}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (identity) ID() byte { return 200 }
+
+func (identity) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (identity) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+	table := NewTable(64, 4, 1, 3)
+	table.Insert([]byte{1, 2, 3, 4})
+	ser, err := table.Serialize(WithCodec(identity{}))
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	if _, err := Deserialize(ser); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("unregistered codec error want %v, get %v", ErrUnsupportedFormat, err)
+	}
+
+	RegisterCodec(identity{})
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, identity{}.ID())
+		codecsMu.Unlock()
+	}()
+	if got, err := Deserialize(ser); err != nil || !table.equal(got) {
+		t.Errorf("registered codec table mismatches, error %v", err)
+	}
+
+	for name, c := range map[string]Codec{
+		"twice":       identity{},
+		"reserved ID": reserved{},
+		"gzip ID":     stdCodec{Gzip.ID(), nil, nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering a codec %s does not panic", name)
+				}
+			}()
+			RegisterCodec(c)
+		}()
+	}
+}
+
+// reserved claims an ID kept for this package
+type reserved struct{ identity }
+
+func (reserved) ID() byte { return 5 }
+
+func TestReadColumnarCells(t *testing.T) {
+	table := NewTable(64, 4, 1, 3)
+	table.Insert([]byte{1, 2, 3, 4})
+	ser, _ := table.Serialize(WithCodec(Flate))
+
+	// replace the cells and fix the checksum up
+	frame := func(cells []byte) []byte {
+		b := append(append([]byte{}, ser[:frameHeader]...), cells...)
+		return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+	}
+	var bomb bytes.Buffer
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	w.Write(make([]byte, 1<<20))
+	w.Close()
+
+	for _, c := range []struct {
+		name  string
+		cells []byte
+		want  error
+	}{
+		{"no codec", nil, ErrCorrupt},
+		{"unknown codec", []byte{99, 0}, ErrUnsupportedFormat},
+		{"bad stream", []byte{Gzip.ID(), 1, 2, 3}, ErrCorrupt},
+		{"too large", append([]byte{Flate.ID()}, bomb.Bytes()...), ErrCorrupt},
+		{"missing columns", append([]byte{0}, make([]byte, 8)...)[:8], ErrCorrupt},
+	} {
+		if _, err := Deserialize(frame(c.cells)); !errors.Is(err, c.want) {
+			t.Errorf("%s: error want %v, get %v", c.name, c.want, err)
+		}
+	}
+}
+
+// endless inflates any input to a full bitmap then zeros without end,
+// counting what it handed out
+type endless struct {
+	identity
+	read *int64
+}
+
+func (endless) ID() byte { return 201 }
+
+func (c endless) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(c), nil
+}
+
+func (c endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+		if *c.read < 1<<13 {
+			p[i] = 0xff
+		}
+		*c.read++
+	}
+	return len(p), nil
+}
+
+func TestReadColumnarCellsInflation(t *testing.T) {
+	var read int64
+	RegisterCodec(endless{read: &read})
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, endless{}.ID())
+		codecsMu.Unlock()
+	}()
+
+	// every one of 65536 buckets of 1 KB occupied, a few bytes of input
+	// must not inflate to the 64 MB the bitmap claims
+	table := NewTable(1<<16, 1024, 1, 3)
+	table.Insert(make([]byte, 1024))
+	ser, _ := table.Serialize(WithCodec(Flate))
+	b := append(append([]byte{}, ser[:frameHeader]...), endless{}.ID(), 1, 2, 3)
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+	if _, err := Deserialize(b); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("deserialize error want %v, get %v", ErrCorrupt, err)
+	}
+	if read > 1<<20 {
+		t.Errorf("inflated %d bytes of 3", read)
+	}
+}
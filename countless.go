@@ -0,0 +1,349 @@
+package iblt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CountlessTable drops the count field of a Table. Its checksum sums item
+// hashes modulo 2^hashBits instead of XORing them, every item hash forced
+// odd, so a bucket holding a single inserted item has the checksum h of the
+// item and one holding a single deleted item has -h, never equal to h.
+// The checksum then tells both purity and the side of the difference.
+//
+// Only sets are supported, an item inserted twice leaves a bucket that can
+// never be peeled.
+type CountlessTable struct {
+	bktNum   uint
+	dataLen  int
+	hashBits int
+	hashNum  int
+	buckets  []countlessBucket
+}
+
+type countlessBucket struct {
+	dataSum []byte
+	hashSum uint64
+}
+
+// Specify number of buckets, data field length (in byte), checksum width
+// (in bit) and number of hash functions
+func NewCountlessTable(buckets uint, dataLen int, hashBits int, hashNum int) (*CountlessTable, error) {
+	// one bit cannot tell h from -h
+	if hashBits < 2 || hashBits > 64 {
+		return nil, fmt.Errorf("checksum width %d out of range 2 to 64 bits", hashBits)
+	}
+	if checkShape(buckets, hashNum) != nil {
+		return nil, fmt.Errorf("%d hash functions out of range 1 to %d buckets", hashNum, buckets)
+	}
+
+	t := &CountlessTable{
+		bktNum:   buckets,
+		dataLen:  dataLen,
+		hashBits: hashBits,
+		hashNum:  hashNum,
+		buckets:  make([]countlessBucket, buckets),
+	}
+	for i := range t.buckets {
+		t.buckets[i].dataSum = make([]byte, dataLen)
+	}
+	return t, nil
+}
+
+func (t CountlessTable) mask() uint64 {
+	return ^uint64(0) >> uint(64-t.hashBits)
+}
+
+// hash is the odd checksum of d
+func (t CountlessTable) hash(d []byte) uint64 {
+	return (binary.BigEndian.Uint64(sipHash(d)) | 1) & t.mask()
+}
+
+func (t *CountlessTable) Insert(d []byte) error {
+	return t.operate(d, true)
+}
+
+func (t *CountlessTable) Delete(d []byte) error {
+	return t.operate(d, false)
+}
+
+func (t *CountlessTable) operate(d []byte, sign bool) error {
+	if len(d) != t.dataLen {
+		return ErrDataLength
+	}
+
+	h := t.hash(d)
+	if !sign {
+		h = -h
+	}
+	for _, i := range indexes(d, t.bktNum, t.hashNum) {
+		bkt := &t.buckets[i]
+		xor(bkt.dataSum, d)
+		bkt.hashSum = (bkt.hashSum + h) & t.mask()
+	}
+	return nil
+}
+
+func (t CountlessTable) check(a *CountlessTable) error {
+	if t.bktNum != a.bktNum {
+		return &ParamMismatchError{"bucket number", int(t.bktNum), int(a.bktNum)}
+	}
+	if t.dataLen != a.dataLen {
+		return &ParamMismatchError{"data length", t.dataLen, a.dataLen}
+	}
+	if t.hashBits != a.hashBits {
+		return &ParamMismatchError{"checksum bits", t.hashBits, a.hashBits}
+	}
+	if t.hashNum != a.hashNum {
+		return &ParamMismatchError{"number of hash functions", t.hashNum, a.hashNum}
+	}
+	return nil
+}
+
+// Modify callee, t = t - a
+func (t *CountlessTable) Subtract(a *CountlessTable) error {
+	if err := t.check(a); err != nil {
+		return err
+	}
+
+	for i := range t.buckets {
+		xor(t.buckets[i].dataSum, a.buckets[i].dataSum)
+		t.buckets[i].hashSum = (t.buckets[i].hashSum - a.buckets[i].hashSum) & t.mask()
+	}
+	return nil
+}
+
+func (t CountlessTable) Copy() *CountlessTable {
+	rtn, _ := NewCountlessTable(t.bktNum, t.dataLen, t.hashBits, t.hashNum)
+	for i, bkt := range t.buckets {
+		copy(rtn.buckets[i].dataSum, bkt.dataSum)
+		rtn.buckets[i].hashSum = bkt.hashSum
+	}
+	return rtn
+}
+
+// pure tells whether the checksum of bucket i is the one of a single item,
+// and on which side. The item may still not belong to the bucket.
+func (t *CountlessTable) pure(i uint) (pure bool, alpha bool) {
+	bkt := t.buckets[i]
+	if bkt.hashSum == 0 {
+		return false, false
+	}
+	h := t.hash(bkt.dataSum)
+	switch bkt.hashSum {
+	case h:
+		alpha = true
+	case -h & t.mask():
+		alpha = false
+	default:
+		return false, false
+	}
+	return true, alpha
+}
+
+func (t CountlessTable) empty() bool {
+	for _, bkt := range t.buckets {
+		if bkt.hashSum != 0 || !empty(bkt.dataSum) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t CountlessTable) residual() int {
+	n := 0
+	for _, bkt := range t.buckets {
+		if bkt.hashSum != 0 || !empty(bkt.dataSum) {
+			n++
+		}
+	}
+	return n
+}
+
+// Decode is self-destructive, alpha holds the items inserted in t and beta
+// the items of the subtracted table
+func (t *CountlessTable) Decode(opts ...DecodeOption) (*Diff, error) {
+	return t.DecodeContext(context.Background(), opts...)
+}
+
+// DecodeContext is Decode stopping once ctx is done or a limit set by the
+// options is reached, as Table.DecodeContext does
+func (t *CountlessTable) DecodeContext(ctx context.Context, opts ...DecodeOption) (*Diff, error) {
+	cfg := newDecodeConfig(opts)
+	var snapshot *CountlessTable
+	if cfg.verify {
+		snapshot = t.Copy()
+	}
+
+	diff := NewDiff(uint(t.residual()))
+	stats := &DecodeStats{}
+	if cfg.stats != nil {
+		defer func() {
+			stats.Collisions = diff.Collisions()
+			stats.Residual = t.residual()
+			*cfg.stats = *stats
+		}()
+	}
+	if err := ctx.Err(); err != nil {
+		return diff, t.decodeError(err, diff)
+	}
+
+	// buckets that may be pure, as in Table.DecodeContext a bucket is only
+	// examined again once peeling an item touched it
+	var work []uint
+	for i := range t.buckets {
+		if pure, _ := t.pure(uint(i)); pure {
+			work = append(work, uint(i))
+		}
+	}
+	roundEnd, round := len(work), 1
+
+	for ; len(work) > 0; stats.Iterations++ {
+		if cfg.maxIterations > 0 && stats.Iterations >= cfg.maxIterations {
+			return diff, t.decodeError(ErrMaxIterations, diff)
+		}
+		if stats.Iterations%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return diff, t.decodeError(err, diff)
+			}
+		}
+		if stats.Iterations == roundEnd {
+			round++
+			roundEnd += len(work)
+		}
+
+		i := work[0]
+		work = work[1:]
+		pure, alpha := t.pure(i)
+		if !pure {
+			continue
+		}
+		stats.PureCells++
+		// peeling changes the bucket, keep the item
+		d := append([]byte{}, t.buckets[i].dataSum...)
+		idxs := indexes(d, t.bktNum, t.hashNum)
+		if !containsIndex(idxs, i) {
+			stats.FalsePure++
+			continue
+		}
+		if diff.backedOut.test(d) {
+			continue
+		}
+		// a set difference holds an item once, a second peel on the same
+		// side is a false pure bucket
+		if alpha && diff.alpha.test(d) || !alpha && diff.beta.test(d) {
+			stats.FalsePure++
+			continue
+		}
+		// past the item limit only items backed out of the other side peel
+		if cfg.maxItems > 0 && diff.AlphaLen()+diff.BetaLen() >= cfg.maxItems {
+			other := diff.beta
+			if !alpha {
+				other = diff.alpha
+			}
+			if !other.test(d) {
+				return diff, t.decodeError(ErrMaxItems, diff)
+			}
+		}
+
+		if err := diff.encodeItem(d, alpha); err != nil && !errors.Is(err, ErrRepetitiveBytes) {
+			return diff, err
+		}
+		stats.Peeled++
+		stats.Rounds = round
+		t.operate(d, !alpha)
+		for _, j := range idxs {
+			if pure, _ := t.pure(j); pure {
+				work = append(work, j)
+			}
+		}
+	}
+
+	if !t.empty() {
+		if stats.Peeled == 0 {
+			return diff, t.decodeError(ErrNoPureBucket, diff)
+		}
+		return diff, t.decodeError(ErrDirtyEntries, diff)
+	}
+
+	if snapshot != nil {
+		rebuilt, _ := NewCountlessTable(t.bktNum, t.dataLen, t.hashBits, t.hashNum)
+		for _, b := range diff.alpha.slice() {
+			rebuilt.Insert(b)
+		}
+		for _, b := range diff.beta.slice() {
+			rebuilt.Delete(b)
+		}
+		for i := range rebuilt.buckets {
+			if rebuilt.buckets[i].hashSum != snapshot.buckets[i].hashSum ||
+				!bytes.Equal(rebuilt.buckets[i].dataSum, snapshot.buckets[i].dataSum) {
+				return diff, t.decodeError(ErrVerification, diff)
+			}
+		}
+	}
+
+	return diff, nil
+}
+
+func (t CountlessTable) decodeError(err error, diff *Diff) *DecodeError {
+	return &DecodeError{
+		Err:        err,
+		Recovered:  diff.AlphaLen() + diff.BetaLen(),
+		Residual:   t.residual(),
+		Collisions: diff.Collisions(),
+	}
+}
+
+// Serialize writes bucket number, data length, checksum width in bits and
+// hash number as big endian uint16, then every bucket, empty ones included,
+// as its data and checksum bits in a single bit stream. It fails for more
+// than 65535 buckets.
+func (t CountlessTable) Serialize() ([]byte, error) {
+	if t.bktNum > math.MaxUint16 || t.dataLen > math.MaxUint16 || t.hashNum > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: %d buckets of %d bytes and %d hash functions", ErrFormatLimit,
+			t.bktNum, t.dataLen, t.hashNum)
+	}
+
+	var buffer bytes.Buffer
+	twoBytes := make([]byte, 2)
+	for _, unsigned := range []uint16{uint16(t.bktNum), uint16(t.dataLen), uint16(t.hashBits), uint16(t.hashNum)} {
+		binary.BigEndian.PutUint16(twoBytes, unsigned)
+		buffer.Write(twoBytes)
+	}
+
+	w := &bitWriter{}
+	for _, bkt := range t.buckets {
+		w.writeBytes(bkt.dataSum, t.dataLen*8)
+		w.write(bkt.hashSum, t.hashBits)
+	}
+	buffer.Write(w.bytes())
+	return buffer.Bytes(), nil
+}
+
+func DeserializeCountless(b []byte) (*CountlessTable, error) {
+	if len(b) < 8 {
+		return nil, ErrCorrupt
+	}
+	bktNum := uint(binary.BigEndian.Uint16(b))
+	dataLen := int(binary.BigEndian.Uint16(b[2:]))
+	hashBits := int(binary.BigEndian.Uint16(b[4:]))
+	hashNum := int(binary.BigEndian.Uint16(b[6:]))
+
+	if len(b)-8 != (int(bktNum)*(dataLen*8+hashBits)+7)/8 {
+		return nil, ErrCorrupt
+	}
+	t, err := NewCountlessTable(bktNum, dataLen, hashBits, hashNum)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	r := &bitReader{buf: b[8:]}
+	for i := range t.buckets {
+		r.readBytes(t.buckets[i].dataSum, dataLen*8)
+		t.buckets[i].hashSum = r.read(hashBits)
+	}
+	return t, nil
+}
@@ -0,0 +1,183 @@
+package iblt
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestCountlessTable_Decode(t *testing.T) {
+	r := testRand(t)
+
+	alice, err := NewCountlessTable(256, 8, 16, 4)
+	if err != nil {
+		t.Fatalf("new countless table error: %v", err)
+	}
+	bob, _ := NewCountlessTable(256, 8, 16, 4)
+	b := make([]byte, 8)
+	for i := 0; i < 1000; i++ {
+		r.Read(b)
+		alice.Insert(b)
+		bob.Insert(b)
+	}
+	alphaWant := newByteSet(0)
+	for i := 0; i < 40; i++ {
+		r.Read(b)
+		alice.Insert(b)
+		alphaWant.insert(append([]byte{}, b...))
+	}
+	betaWant := newByteSet(0)
+	for i := 0; i < 30; i++ {
+		r.Read(b)
+		bob.Insert(b)
+		betaWant.insert(append([]byte{}, b...))
+	}
+
+	ser, err := bob.Serialize()
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	// no count, 64 data and 16 checksum bits a bucket
+	if want := 8 + 256*80/8; len(ser) != want {
+		t.Errorf("serialized length want %d, get %d", want, len(ser))
+	}
+	remote, err := DeserializeCountless(ser)
+	if err != nil {
+		t.Fatalf("deserialize error: %v", err)
+	}
+	if _, err := DeserializeCountless(ser[:len(ser)-1]); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("truncated deserialize error want %v, get %v", ErrCorrupt, err)
+	}
+
+	other, _ := NewCountlessTable(256, 8, 8, 4)
+	if err := alice.Subtract(other); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("subtract error want %v, get %v", ErrParamMismatch, err)
+	}
+	if err := alice.Subtract(remote); err != nil {
+		t.Fatalf("subtract error: %v", err)
+	}
+	diff, err := alice.Decode(WithVerify())
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if diff.AlphaLen() != 40 || diff.BetaLen() != 30 {
+		t.Fatalf("decode diff number mismatched want 40/30, get %d/%d", diff.AlphaLen(), diff.BetaLen())
+	}
+	for _, b := range diff.AlphaSlice() {
+		if !alphaWant.test(b) {
+			t.Errorf("alpha item %v decoded on the wrong side", b)
+		}
+	}
+	for _, b := range diff.BetaSlice() {
+		if !betaWant.test(b) {
+			t.Errorf("beta item %v decoded on the wrong side", b)
+		}
+	}
+}
+
+func TestCountlessTableDecodeContext(t *testing.T) {
+	r := testRand(t)
+
+	table, _ := NewCountlessTable(1024, 8, 16, 4)
+	b := make([]byte, 8)
+	for i := 0; i < 300; i++ {
+		r.Read(b)
+		table.Insert(b)
+	}
+
+	var decodeErr *DecodeError
+	diff, err := table.Copy().Decode(WithMaxItems(100))
+	if !errors.Is(err, ErrMaxItems) || !errors.As(err, &decodeErr) {
+		t.Errorf("decode error want %v, get %v", ErrMaxItems, err)
+	} else if diff.AlphaLen() != 100 || decodeErr.Recovered != 100 {
+		t.Errorf("partial diff want 100 items, get %d", diff.AlphaLen())
+	}
+
+	var stats DecodeStats
+	diff, err = table.Copy().Decode(WithMaxIterations(50), WithStats(&stats))
+	if !errors.Is(err, ErrMaxIterations) {
+		t.Errorf("decode error want %v, get %v", ErrMaxIterations, err)
+	} else if diff.AlphaLen() > 50 || stats.Iterations != 50 {
+		t.Errorf("partial diff want at most 50 items in 50 iterations, get %d in %d", diff.AlphaLen(), stats.Iterations)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := table.Copy().DecodeContext(ctx); !errors.Is(err, context.Canceled) || !errors.As(err, &decodeErr) {
+		t.Errorf("decode error want %v, get %v", context.Canceled, err)
+	}
+
+	// limits above the difference change nothing
+	diff, err = table.DecodeContext(context.Background(), WithMaxItems(300), WithStats(&stats))
+	if err != nil || diff.AlphaLen() != 300 {
+		t.Fatalf("decode error: %v, %d items", err, diff.AlphaLen())
+	}
+	if stats.Peeled != 300 || stats.PureCells < 300 || stats.Rounds < 1 || stats.Residual != 0 {
+		t.Errorf("inconsistent stats %+v", stats)
+	}
+	// only buckets a peel touched are examined again
+	if stats.Iterations > 1024+4*stats.Peeled {
+		t.Errorf("%d iterations for %d peeled items", stats.Iterations, stats.Peeled)
+	}
+}
+
+// a countless table with a 16 bit checksum decodes about as often as a
+// table with a 16 bit checksum and a 16 bit count
+func TestCountlessTable_SuccessRate(t *testing.T) {
+	const (
+		trials  = 200
+		buckets = 200
+		diffs   = 150
+	)
+	r := rand.New(rand.NewSource(1))
+	var tableOK, countlessOK int
+	b := make([]byte, 8)
+	for trial := 0; trial < trials; trial++ {
+		table := NewTable(buckets, 8, 2, 3)
+		countless, _ := NewCountlessTable(buckets, 8, 16, 3)
+		for i := 0; i < diffs; i++ {
+			r.Read(b)
+			if i%2 == 0 {
+				table.Insert(b)
+				countless.Insert(b)
+			} else {
+				table.Delete(b)
+				countless.Delete(b)
+			}
+		}
+		if diff, err := table.Decode(); err == nil && diff.AlphaLen()+diff.BetaLen() == diffs {
+			tableOK++
+		}
+		if diff, err := countless.Decode(); err == nil && diff.AlphaLen()+diff.BetaLen() == diffs {
+			countlessOK++
+		}
+	}
+	t.Logf("decoded %d/%d tables, %d/%d countless tables", tableOK, trials, countlessOK, trials)
+	if countlessOK < tableOK-trials/20 {
+		t.Errorf("countless tables decoded %d times, tables %d times out of %d", countlessOK, tableOK, trials)
+	}
+}
+
+func TestNewCountlessTable(t *testing.T) {
+	for _, bits := range []int{0, 1, 65} {
+		if _, err := NewCountlessTable(64, 8, bits, 3); err == nil {
+			t.Errorf("%d checksum bits accepted", bits)
+		}
+	}
+	for _, c := range [][2]int{{0, 1}, {2, 3}, {8, 0}} {
+		if _, err := NewCountlessTable(uint(c[0]), 8, 8, c[1]); err == nil {
+			t.Errorf("%d hash functions over %d buckets accepted", c[1], c[0])
+		}
+	}
+	// headers of 0 buckets and of more hash functions than buckets
+	for _, b := range [][]byte{{0, 0, 0, 1, 0, 8, 0, 1}, {0, 1, 0, 1, 0, 8, 0, 2, 0, 0}} {
+		if _, err := DeserializeCountless(b); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("deserialize %v error want %v, get %v", b, ErrCorrupt, err)
+		}
+	}
+	big, _ := NewCountlessTable(1<<16, 1, 8, 3)
+	if _, err := big.Serialize(); !errors.Is(err, ErrFormatLimit) {
+		t.Error("65536 buckets serialized")
+	}
+}
@@ -0,0 +1,46 @@
+package iblt
+
+// DecodeOption tunes a single call to Decode.
+type DecodeOption func(*decodeConfig)
+
+type decodeConfig struct {
+	verify bool
+	// 0 means no limit
+	maxIterations int
+	maxItems      int
+	stats         *DecodeStats
+}
+
+func newDecodeConfig(opts []DecodeOption) *decodeConfig {
+	cfg := &decodeConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithVerify rebuilds a table from the decoded items and compares it with
+// the table before decoding, failing with ErrVerification on any difference.
+// It costs a copy of the table and a second round of insertions.
+func WithVerify() DecodeOption {
+	return func(c *decodeConfig) {
+		c.verify = true
+	}
+}
+
+// WithMaxIterations stops decoding with ErrMaxIterations after n peeling
+// steps, each step peeling one bucket, successful or not. It bounds the
+// work spent on a table engineered to be slow to peel.
+func WithMaxIterations(n int) DecodeOption {
+	return func(c *decodeConfig) {
+		c.maxIterations = n
+	}
+}
+
+// WithMaxItems stops decoding with ErrMaxItems before an item past the nth
+// is decoded, rejecting a difference larger than the caller can handle.
+func WithMaxItems(n int) DecodeOption {
+	return func(c *decodeConfig) {
+		c.maxItems = n
+	}
+}
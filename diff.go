@@ -0,0 +1,95 @@
+package iblt
+
+import (
+	"bytes"
+	"iter"
+	"sort"
+)
+
+// Set is the application state a Diff can be applied to, *Table is one
+type Set interface {
+	Insert(b []byte) error
+	Delete(b []byte) error
+}
+
+// Alpha iterates over the items only the subtracted-from table holds
+func (d Diff) Alpha() iter.Seq[[]byte] {
+	return d.alpha.all()
+}
+
+// Beta iterates over the items only the subtracted table holds
+func (d Diff) Beta() iter.Seq[[]byte] {
+	return d.beta.all()
+}
+
+// Invert swaps alpha and beta, as if the tables were subtracted the other way
+func (d *Diff) Invert() {
+	d.alpha, d.beta = d.beta, d.alpha
+}
+
+// Merge adds the items of o to d, such as the diffs decoded from the shards
+// of a table. An item on opposite sides of d and o cancels out and counts as
+// a collision.
+func (d *Diff) Merge(o *Diff) {
+	for _, b := range o.alpha.slice() {
+		d.merge(b, d.alpha, d.beta)
+	}
+	for _, b := range o.beta.slice() {
+		d.merge(b, d.beta, d.alpha)
+	}
+	for _, b := range o.backedOut.slice() {
+		d.backedOut.insert(b)
+	}
+}
+
+func (d *Diff) merge(b []byte, same, opposite *byteSet) {
+	if opposite.test(b) {
+		opposite.delete(b)
+		d.backedOut.insert(b)
+		return
+	}
+	same.insert(b)
+}
+
+// Sort orders both sides bytewise, so that the output of AlphaSlice, BetaSlice
+// and the iterators does not depend on decoding order
+func (d *Diff) Sort() {
+	d.alpha.sort()
+	d.beta.sort()
+}
+
+// Apply turns the set that was inserted into the subtracted-from table into
+// the set of the subtracted table, by deleting alpha and inserting beta.
+// After local.Subtract(remote) it brings local state in line with remote.
+func (d Diff) Apply(s Set) error {
+	for _, b := range d.alpha.slice() {
+		if err := s.Delete(b); err != nil {
+			return err
+		}
+	}
+	for _, b := range d.beta.slice() {
+		if err := s.Insert(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s byteSet) all() iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for _, b := range s.set {
+			if !yield(b) {
+				return
+			}
+		}
+	}
+}
+
+func (s *byteSet) sort() {
+	sort.Slice(s.set, func(i, j int) bool {
+		return bytes.Compare(s.set[i], s.set[j]) < 0
+	})
+	for i, b := range s.set {
+		s.index[string(b)] = i
+	}
+}
@@ -0,0 +1,130 @@
+package iblt
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestDiff(alpha, beta []byte) *Diff {
+	diff := NewDiff(8)
+	for _, b := range alpha {
+		diff.alpha.insert([]byte{b})
+	}
+	for _, b := range beta {
+		diff.beta.insert([]byte{b})
+	}
+	return diff
+}
+
+func collect(seq func(func([]byte) bool)) [][]byte {
+	var rtn [][]byte
+	for b := range seq {
+		rtn = append(rtn, b)
+	}
+	return rtn
+}
+
+func TestDiff_Iterators(t *testing.T) {
+	diff := newTestDiff([]byte{3, 1, 2}, []byte{9})
+	if get := collect(diff.Alpha()); !reflect.DeepEqual(get, [][]byte{{3}, {1}, {2}}) {
+		t.Errorf("alpha iterator mismatch get %v", get)
+	}
+	if get := collect(diff.Beta()); !reflect.DeepEqual(get, [][]byte{{9}}) {
+		t.Errorf("beta iterator mismatch get %v", get)
+	}
+
+	// stopping early
+	for b := range diff.Alpha() {
+		if b[0] != 3 {
+			t.Errorf("first alpha want 3, get %v", b)
+		}
+		break
+	}
+
+	diff.Sort()
+	if get := diff.AlphaSlice(); !reflect.DeepEqual(get, [][]byte{{1}, {2}, {3}}) {
+		t.Errorf("sorted alpha mismatch get %v", get)
+	}
+	// the index follows the sorted order
+	diff.alpha.delete([]byte{1})
+	if get := diff.AlphaSlice(); !reflect.DeepEqual(get, [][]byte{{3}, {2}}) {
+		t.Errorf("delete after sort mismatch get %v", get)
+	}
+
+	diff.Invert()
+	if diff.AlphaLen() != 1 || diff.BetaLen() != 2 {
+		t.Errorf("invert did not swap sides, alpha %v, beta %v", diff.AlphaSlice(), diff.BetaSlice())
+	}
+}
+
+func TestDiff_Merge(t *testing.T) {
+	diff := newTestDiff([]byte{1, 2}, []byte{7})
+	diff.Merge(newTestDiff([]byte{3, 7}, []byte{8, 1}))
+	diff.Sort()
+
+	if get := diff.AlphaSlice(); !reflect.DeepEqual(get, [][]byte{{2}, {3}}) {
+		t.Errorf("merged alpha mismatch get %v", get)
+	}
+	if get := diff.BetaSlice(); !reflect.DeepEqual(get, [][]byte{{8}}) {
+		t.Errorf("merged beta mismatch get %v", get)
+	}
+	if diff.Collisions() != 2 {
+		t.Errorf("merge collisions want 2, get %d", diff.Collisions())
+	}
+}
+
+type testSet map[string]bool
+
+func (s testSet) Insert(b []byte) error {
+	s[string(b)] = true
+	return nil
+}
+
+func (s testSet) Delete(b []byte) error {
+	delete(s, string(b))
+	return nil
+}
+
+func (s testSet) sorted() [][]byte {
+	var rtn [][]byte
+	for k := range s {
+		rtn = append(rtn, []byte(k))
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		return bytes.Compare(rtn[i], rtn[j]) < 0
+	})
+	return rtn
+}
+
+func TestDiff_Apply(t *testing.T) {
+	local := testSet{}
+	remote := testSet{}
+	localTable := NewTable(80, 1, 1, 4)
+	remoteTable := NewTable(80, 1, 1, 4)
+	for b := byte(0); b < 100; b++ {
+		if b%7 != 0 {
+			local.Insert([]byte{b})
+			localTable.Insert([]byte{b})
+		}
+		if b%5 != 0 {
+			remote.Insert([]byte{b})
+			remoteTable.Insert([]byte{b})
+		}
+	}
+
+	if err := localTable.Subtract(remoteTable); err != nil {
+		t.Fatalf("subtract error: %v", err)
+	}
+	diff, err := localTable.Decode()
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if err := diff.Apply(local); err != nil {
+		t.Fatalf("apply error: %v", err)
+	}
+	if !reflect.DeepEqual(local.sorted(), remote.sorted()) {
+		t.Errorf("applied set mismatch want %v, get %v", remote.sorted(), local.sorted())
+	}
+}
@@ -0,0 +1,147 @@
+package iblt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// number of bucket ranges in the occupancy histogram of Dump
+const dumpRanges = 16
+
+// Dump prints the parameters of t, an occupancy histogram over bucket
+// ranges, the distribution of bucket counts, the number of pure buckets and
+// every non-empty bucket with its sums in hex
+func (t Table) Dump(w io.Writer) error {
+	return t.DumpEncoded(w, hex.EncodeToString)
+}
+
+// DumpSerialized is DumpEncoded of the table serialized in b, preceded by
+// the format b is in, its version, hash function, cell mode and codec for
+// the framed format. A nil encode prints hex.
+func DumpSerialized(w io.Writer, b []byte, encode func([]byte) string) error {
+	t, err := Deserialize(b)
+	if err != nil {
+		return err
+	}
+	if encode == nil {
+		encode = hex.EncodeToString
+	}
+	if _, err := fmt.Fprintln(w, serializedFormat(b)); err != nil {
+		return err
+	}
+	return t.DumpEncoded(w, encode)
+}
+
+var (
+	cellModeNames = map[byte]string{
+		cellsSparse:   "sparse",
+		cellsPacked:   "packed",
+		cellsBitmap:   "bitmap",
+		cellsColumnar: "columnar",
+	}
+	codecNames = map[byte]string{
+		0:          "none",
+		Flate.ID(): "flate",
+		Gzip.ID():  "gzip",
+		Zlib.ID():  "zlib",
+	}
+)
+
+// serializedFormat describes the format of b, which Deserialize accepted
+func serializedFormat(b []byte) string {
+	if !bytes.HasPrefix(b, []byte(frameMagic)) {
+		return fmt.Sprintf("format legacy, %d bytes", len(b))
+	}
+
+	mode := b[10]
+	rtn := fmt.Sprintf("format version %d, hash SipHash-2-4, key fingerprint %08x, %s cells",
+		b[4], binary.BigEndian.Uint32(b[6:]), cellModeNames[mode])
+	if mode == cellsColumnar {
+		id := b[frameHeader]
+		name, ok := codecNames[id]
+		if !ok {
+			name = fmt.Sprintf("%d", id)
+		}
+		rtn += ", codec " + name
+	}
+	return rtn + fmt.Sprintf(", %d bytes", len(b))
+}
+
+// DumpEncoded is Dump printing the bucket sums with encode, such as
+// base64.StdEncoding.EncodeToString
+func (t Table) DumpEncoded(w io.Writer, encode func([]byte) string) error {
+	bw := bufio.NewWriter(w)
+
+	countWidth := "unbounded"
+	if t.packed() {
+		countWidth = fmt.Sprintf("%d bits", t.countBits)
+	}
+	fmt.Fprintf(bw, "buckets %d, data %d bytes, checksum %d bits, count %s, %d hash functions\n",
+		t.bktNum, t.dataLen, t.hashBits, countWidth, t.hashNum)
+
+	occupied := make([]int, dumpRanges)
+	counts := make(map[int]int)
+	used, pure, falsePure := 0, 0, 0
+	for i, bkt := range t.buckets {
+		if bkt == nil || bkt.empty() {
+			continue
+		}
+		used++
+		occupied[uint64(i)*dumpRanges/uint64(t.bktNum)]++
+		counts[bkt.count]++
+		if bkt.pure() {
+			if containsIndex(indexes(bkt.dataSum, t.bktNum, t.hashNum), uint(i)) {
+				pure++
+			} else {
+				falsePure++
+			}
+		}
+	}
+	fmt.Fprintf(bw, "occupied %d of %d buckets (%.1f%%), %d pure, %d false pure\n",
+		used, t.bktNum, 100*float64(used)/float64(t.bktNum), pure, falsePure)
+
+	fmt.Fprintln(bw, "\noccupancy by bucket range")
+	for r, n := range occupied {
+		// the buckets i of range r have i*dumpRanges/bktNum == r
+		lo := (uint64(t.bktNum)*uint64(r) + dumpRanges - 1) / dumpRanges
+		hi := (uint64(t.bktNum)*uint64(r+1) + dumpRanges - 1) / dumpRanges
+		if hi == lo {
+			continue
+		}
+		share := float64(n) / float64(hi-lo)
+		fmt.Fprintf(bw, "  %6d-%-6d %5.1f%% %s\n", lo, hi-1, 100*share, strings.Repeat("#", int(share*40+0.5)))
+	}
+
+	fmt.Fprintln(bw, "\ncount distribution of occupied buckets")
+	values := make([]int, 0, len(counts))
+	for c := range counts {
+		values = append(values, c)
+	}
+	sort.Ints(values)
+	for _, c := range values {
+		fmt.Fprintf(bw, "  %6d %6d\n", c, counts[c])
+	}
+
+	fmt.Fprintln(bw, "\nbuckets")
+	for i, bkt := range t.buckets {
+		if bkt == nil || bkt.empty() {
+			continue
+		}
+		mark := ""
+		if bkt.pure() {
+			mark = " pure"
+			if !containsIndex(indexes(bkt.dataSum, t.bktNum, t.hashNum), uint(i)) {
+				mark = " false pure"
+			}
+		}
+		fmt.Fprintf(bw, "  %6d count %4d data %s hash %s%s\n", i, bkt.count, encode(bkt.dataSum), encode(bkt.hashSum), mark)
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,84 @@
+package iblt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestTableDump(t *testing.T) {
+	table := NewTable(8, 2, 1, 2)
+	table.Insert([]byte{0xab, 0xcd})
+	var out bytes.Buffer
+	if err := table.Dump(&out); err != nil {
+		t.Fatalf("dump error: %v", err)
+	}
+	dump := out.String()
+	for _, want := range []string{
+		"buckets 8, data 2 bytes, checksum 8 bits, count unbounded, 2 hash functions",
+		"occupied 2 of 8 buckets (25.0%), 2 pure, 0 false pure",
+		"       1      2\n",
+		"count    1 data abcd hash ",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump lacks %q:\n%s", want, dump)
+		}
+	}
+	cells := dump[strings.Index(dump, "\nbuckets\n"):]
+	if n := strings.Count(cells, " pure\n"); n != 2 {
+		t.Errorf("dump marks %d pure buckets, want 2:\n%s", n, dump)
+	}
+
+	packed, _ := NewPackedTable(8, 2, 4, 3, 2)
+	packed.Insert([]byte{0xab, 0xcd})
+	out.Reset()
+	if err := packed.DumpEncoded(&out, base64.StdEncoding.EncodeToString); err != nil {
+		t.Fatalf("dump error: %v", err)
+	}
+	if dump := out.String(); !strings.Contains(dump, "checksum 4 bits, count 3 bits") || !strings.Contains(dump, "data q80= hash ") {
+		t.Errorf("encoded dump mismatch:\n%s", dump)
+	}
+}
+
+func TestDumpSerialized(t *testing.T) {
+	table := NewTable(8, 2, 1, 2)
+	table.Insert([]byte{0xab, 0xcd})
+	legacy, err := table.SerializeLegacy()
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	plain, err := table.Serialize()
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	compressed, err := table.Serialize(WithCodec(Zlib))
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+
+	cases := []struct {
+		b    []byte
+		want string
+	}{
+		{legacy, "format legacy, "},
+		{plain, "format version 1, hash SipHash-2-4, key fingerprint "},
+		{compressed, "columnar cells, codec zlib, "},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		if err := DumpSerialized(&out, c.b, nil); err != nil {
+			t.Fatalf("dump error: %v", err)
+		}
+		if !strings.Contains(out.String(), c.want) {
+			t.Errorf("dump lacks %q:\n%s", c.want, out.String())
+		}
+		if !strings.Contains(out.String(), "abcd") {
+			t.Errorf("dump lacks the hex data sum:\n%s", out.String())
+		}
+	}
+
+	if err := DumpSerialized(&bytes.Buffer{}, []byte("IBL"), nil); err == nil {
+		t.Error("dumped a truncated table")
+	}
+}
@@ -0,0 +1,147 @@
+package iblt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// an item does not have the data length of the table
+	ErrDataLength = errors.New("insert byte length mismatches base data length")
+
+	// two tables do not share bucket number, data length, hash length or hash number
+	ErrParamMismatch = errors.New("table parameters mismatch")
+
+	// decoding stopped before any bucket could be peeled
+	ErrNoPureBucket = errors.New("no pure buckets in table")
+
+	// decoding ran out of pure buckets with non-empty buckets left
+	ErrDirtyEntries = errors.New("dirty entries remained")
+
+	// the same item was decoded on both sides of the difference
+	ErrRepetitiveBytes = errors.New("repetitive bytes found")
+
+	// the decoded items do not add up to the table they were decoded from
+	ErrVerification = errors.New("decoded items mismatch table")
+
+	// stored table data fails its consistency checks
+	ErrCorrupt = errors.New("corrupt table data")
+
+	// an item timestamp falls outside the epochs of a WindowedTable
+	ErrOutsideWindow = errors.New("timestamp outside window")
+
+	// two different items have the same short ID
+	ErrShortIDCollision = errors.New("short ID collision")
+
+	// a serialized table comes from a later version or another hash function
+	ErrUnsupportedFormat = errors.New("unsupported table format")
+
+	// decoding took more peeling steps than WithMaxIterations allows
+	ErrMaxIterations = errors.New("maximum decode iterations reached")
+
+	// decoding found more items than WithMaxItems allows
+	ErrMaxItems = errors.New("maximum decoded items reached")
+
+	// an item or peer is added where it is already present
+	ErrDuplicate = errors.New("already present")
+
+	// an item or short ID is looked up where it is not present
+	ErrNotFound = errors.New("not present")
+
+	// a table does not fit the format it is serialized in
+	ErrFormatLimit = errors.New("table exceeds format limits")
+)
+
+// ParamMismatchError tells which parameter differs between two tables.
+// It matches ErrParamMismatch with errors.Is.
+type ParamMismatchError struct {
+	Param string
+	Want  int
+	Got   int
+}
+
+func (e *ParamMismatchError) Error() string {
+	return fmt.Sprintf("table mismatches %s, want %d, get %d", e.Param, e.Want, e.Got)
+}
+
+func (e *ParamMismatchError) Unwrap() error {
+	return ErrParamMismatch
+}
+
+// DecodeError reports how far decoding went before it failed.
+// Err is one of the decode sentinel errors, or the context error if
+// DecodeContext was cancelled.
+type DecodeError struct {
+	Err error
+	// number of items recovered into the returned Diff
+	Recovered int
+	// number of non-empty buckets left in the table
+	Residual int
+	// number of false pure buckets backed out
+	Collisions int
+}
+
+func (e *DecodeError) Error() string {
+	if e.Collisions > 0 {
+		return fmt.Sprintf("%v, %d items recovered, %d buckets remained, %d collisions",
+			e.Err, e.Recovered, e.Residual, e.Collisions)
+	}
+	return fmt.Sprintf("%v, %d items recovered, %d buckets remained", e.Err, e.Recovered, e.Residual)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ShardError holds the decode error of every shard of a ShardedTable that
+// failed to decode. errors.Is and errors.As look into each of them.
+type ShardError struct {
+	Errs map[int]error
+}
+
+// Failed lists the failed shards in increasing order
+func (e *ShardError) Failed() []int {
+	failed := make([]int, 0, len(e.Errs))
+	for i := range e.Errs {
+		failed = append(failed, i)
+	}
+	sort.Ints(failed)
+	return failed
+}
+
+func (e *ShardError) Error() string {
+	failed := e.Failed()
+	if len(failed) == 1 {
+		return fmt.Sprintf("shard %d: %v", failed[0], e.Errs[failed[0]])
+	}
+	return fmt.Sprintf("%d shards failed to decode %v, first shard %d: %v",
+		len(failed), failed, failed[0], e.Errs[failed[0]])
+}
+
+func (e *ShardError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errs))
+	for _, i := range e.Failed() {
+		errs = append(errs, e.Errs[i])
+	}
+	return errs
+}
+
+// PairError holds the decode error of every pair of peers a Coordinator
+// failed to decode. errors.Is and errors.As look into each of them.
+type PairError struct {
+	Pairs [][2]string
+	Errs  []error
+}
+
+func (e *PairError) Error() string {
+	if len(e.Pairs) == 1 {
+		return fmt.Sprintf("peers %s and %s: %v", e.Pairs[0][0], e.Pairs[0][1], e.Errs[0])
+	}
+	return fmt.Sprintf("%d pairs of peers failed to decode, first %s and %s: %v",
+		len(e.Pairs), e.Pairs[0][0], e.Pairs[0][1], e.Errs[0])
+}
+
+func (e *PairError) Unwrap() []error {
+	return e.Errs
+}
@@ -2,10 +2,12 @@ package iblt
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/dchest/siphash"
-	"github.com/golang-collections/collections/queue"
+	"math"
 	"github.com/willf/bitset"
 )
 
@@ -15,25 +17,84 @@ type Table struct {
 	hashLen int
 	hashNum int
 	buckets []*Bucket
-	bitsSet *bitset.BitSet
+	// buckets shared with a snapshot, copied before they are modified
+	shared *bitset.BitSet
+	// checksum and count widths of a packed table, hashBits is hashLen*8
+	// and countBits 0 otherwise
+	hashBits  int
+	countBits int
+	observer  Observer
 }
 
 // Specify number of buckets, data field length (in byte), number of hash functions
+// The checksum is 1 to 8 bytes long and every item takes 1 to buckets
+// distinct buckets, NewTable panics otherwise.
 func NewTable(buckets uint, dataLen int, hashLen int, hashNum int, ) *Table {
+	if hashLen < 1 || hashLen > maxHashBits/8 {
+		panic(fmt.Sprintf("iblt: checksum length %d out of range 1 to %d bytes", hashLen, maxHashBits/8))
+	}
+	if err := checkShape(buckets, hashNum); err != nil {
+		panic(fmt.Sprintf("iblt: %d hash functions out of range 1 to %d buckets", hashNum, buckets))
+	}
 	return &Table{
-		bktNum:  buckets,
-		dataLen: dataLen,
-		hashLen: hashLen,
-		hashNum: hashNum,
-		buckets: make([]*Bucket, buckets),
-		bitsSet: bitset.New(buckets),
+		bktNum:   buckets,
+		dataLen:  dataLen,
+		hashLen:  hashLen,
+		hashNum:  hashNum,
+		buckets:  make([]*Bucket, buckets),
+		hashBits: hashLen * 8,
 	}
 }
 
+// NewPackedTable specifies the checksum and count widths in bits instead of
+// bytes, such as a 4 bit checksum and a 3 bit count, and serializes buckets
+// bit packed. Counts wrap around at countBits, a bucket is pure when its
+// count is 1 or -1 modulo 2^countBits. The short checksum lets more buckets
+// pass as pure, the index membership check weeds most of them out and
+// decoding backs out the few left.
+func NewPackedTable(buckets uint, dataLen int, hashBits int, countBits int, hashNum int) (*Table, error) {
+	if hashBits < 1 || hashBits > maxHashBits {
+		return nil, fmt.Errorf("checksum width %d out of range 1 to %d bits", hashBits, maxHashBits)
+	}
+	// a single bit cannot tell 1 from -1
+	if countBits < 2 || countBits > maxCountBits {
+		return nil, fmt.Errorf("count width %d out of range 2 to %d bits", countBits, maxCountBits)
+	}
+	if checkShape(buckets, hashNum) != nil {
+		return nil, fmt.Errorf("%d hash functions out of range 1 to %d buckets", hashNum, buckets)
+	}
+
+	t := NewTable(buckets, dataLen, (hashBits+7)/8, hashNum)
+	t.hashBits = hashBits
+	t.countBits = countBits
+	return t, nil
+}
+
+// packed tells whether t was made by NewPackedTable
+func (t Table) packed() bool {
+	return t.countBits > 0
+}
+
+// blank returns an empty table of the same parameters as t
+func (t Table) blank() *Table {
+	rtn := NewTable(t.bktNum, t.dataLen, t.hashLen, t.hashNum)
+	rtn.hashBits = t.hashBits
+	rtn.countBits = t.countBits
+	rtn.observer = t.observer
+	return rtn
+}
+
+func (t Table) newBucket() *Bucket {
+	return newBucket(t.dataLen, t.hashBits, t.countBits)
+}
+
 func (t *Table) Insert(d []byte) error {
 	if err := t.operate(d, true); err != nil {
 		return err
 	}
+	if t.observer != nil {
+		t.observer.ObserveInsert(d)
+	}
 
 	return nil
 }
@@ -42,54 +103,62 @@ func (t *Table) Delete(d []byte) error {
 	if err := t.operate(d, false); err != nil {
 		return err
 	}
+	if t.observer != nil {
+		t.observer.ObserveDelete(d)
+	}
 
 	return nil
 }
 
 func (t *Table) operate(d []byte, sign bool) error {
-	cpy := make([]byte, len(d))
-	copy(cpy, d)
-	err := t.index(cpy)
-	if err != nil {
-		return err
+	if len(d) != t.dataLen {
+		return ErrDataLength
 	}
 
-	for i, e := t.bitsSet.NextSet(0); e; i, e = t.bitsSet.NextSet(i + 1) {
+	cpy := make([]byte, len(d))
+	copy(cpy, d)
+	for _, i := range indexes(cpy, t.bktNum, t.hashNum) {
 		t.operateBucket(i, cpy, sign)
 	}
 
 	return nil
 }
 
-func (t *Table) index(d []byte) error {
-	if len(d) != t.dataLen {
-		return errors.New("insert byte length mismatches base data length")
-	}
-
-	if t.bitsSet == nil {
-		t.bitsSet = bitset.New(t.bktNum)
-	}
-
-	t.bitsSet.ClearAll()
+// indexes returns the hashNum distinct buckets of d
+func indexes(d []byte, bktNum uint, hashNum int) []uint {
+	rtn := make([]uint, 0, hashNum)
 	tries := 1
-	for i := 0; i < t.hashNum; {
+	for len(rtn) < hashNum {
 		// assume we can always find different keys
 		// as this is in high probability
 		h := siphash.Hash(key0, uint64(key1+tries), d)
 		tries++
 		// TODO: modulo produces imbalanced uniform distribution
-		idx := uint(h) % t.bktNum
-		if !t.bitsSet.Test(idx) {
-			t.bitsSet.Set(idx)
-			i++
+		idx := uint(h) % bktNum
+		if !containsIndex(rtn, idx) {
+			rtn = append(rtn, idx)
 		}
 	}
+	return rtn
+}
 
-	return nil
+func containsIndex(idxs []uint, idx uint) bool {
+	for _, i := range idxs {
+		if i == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// DataLen is the length of the items of t
+func (t Table) DataLen() int {
+	return t.dataLen
 }
 
+// Copy returns a deep copy, no bucket is shared with t
 func (t Table) Copy() *Table {
-	rtn := NewTable(t.bktNum, t.dataLen, t.hashLen, t.hashNum)
+	rtn := t.blank()
 	for i, bkt := range t.buckets {
 		if bkt != nil {
 			rtn.buckets[i] = bkt.copy()
@@ -99,6 +168,37 @@ func (t Table) Copy() *Table {
 	return rtn
 }
 
+// Snapshot returns a copy-on-write copy of t. Both tables share buckets
+// until either one modifies a bucket, which is copied first. It is cheaper
+// than Copy for large tables of which only a part changes afterwards.
+func (t *Table) Snapshot() *Table {
+	if t.shared == nil {
+		t.shared = bitset.New(t.bktNum)
+	}
+	for i, bkt := range t.buckets {
+		if bkt != nil {
+			t.shared.Set(uint(i))
+		}
+	}
+
+	rtn := t.blank()
+	copy(rtn.buckets, t.buckets)
+	rtn.shared = t.shared.Clone()
+	return rtn
+}
+
+// writable returns bucket idx ready to be modified, it is created if missing
+// and copied if shared with a snapshot
+func (t *Table) writable(idx uint) *Bucket {
+	if t.buckets[idx] == nil {
+		t.buckets[idx] = t.newBucket()
+	} else if t.shared != nil && t.shared.Test(idx) {
+		t.buckets[idx] = t.buckets[idx].copy()
+		t.shared.Clear(idx)
+	}
+	return t.buckets[idx]
+}
+
 // Modify callee, t = t - a
 func (t *Table) Subtract(a *Table) error {
 	err := t.check(a)
@@ -108,66 +208,224 @@ func (t *Table) Subtract(a *Table) error {
 
 	for i := range t.buckets {
 		if t.buckets[i] != nil && a.buckets[i] != nil {
-			t.buckets[i].subtract(a.buckets[i])
+			t.writable(uint(i)).subtract(a.buckets[i])
 		}
 		if t.buckets[i] == nil && a.buckets[i] != nil {
 			t.buckets[i] = a.buckets[i].copy()
 			t.buckets[i].count = -t.buckets[i].count
+			t.buckets[i].wrap()
 		}
 	}
+	if t.observer != nil {
+		t.observer.ObserveSubtract(a)
+	}
+
+	return nil
+}
+
+// Modify callee, t = t + a, as if a's items were inserted into t
+func (t *Table) Add(a *Table) error {
+	err := t.check(a)
+	if err != nil {
+		return err
+	}
+
+	for i := range t.buckets {
+		if t.buckets[i] != nil && a.buckets[i] != nil {
+			t.writable(uint(i)).add(a.buckets[i])
+		}
+		if t.buckets[i] == nil && a.buckets[i] != nil {
+			t.buckets[i] = a.buckets[i].copy()
+		}
+	}
+	if t.observer != nil {
+		t.observer.ObserveAdd(a)
+	}
 
 	return nil
 }
 
 // Decode is self-destructive
-func (t *Table) Decode() (*Diff, error) {
-	diff := NewDiff(t.bktNum)
-	if t.empty() {
+func (t *Table) Decode(opts ...DecodeOption) (*Diff, error) {
+	return t.DecodeContext(context.Background(), opts...)
+}
+
+// how many peeling steps go by between checks of the context
+const ctxCheckInterval = 1024
+
+// DecodeContext is Decode stopping once ctx is done. On cancellation or a
+// limit set by the options it returns the items decoded so far with a
+// *DecodeError, the table is left partially peeled.
+func (t *Table) DecodeContext(ctx context.Context, opts ...DecodeOption) (*Diff, error) {
+	cfg := newDecodeConfig(opts)
+	var snapshot *Table
+	if cfg.verify {
+		snapshot = t.Snapshot()
+	}
+
+	// sized from the non-empty buckets, a large table of a small
+	// difference does not pay for sets as large as the table
+	occupied := t.residual()
+	diff := NewDiff(uint(occupied))
+	stats := &DecodeStats{}
+	if cfg.stats != nil {
+		defer func() {
+			stats.Collisions = diff.Collisions()
+			stats.Residual = t.residual()
+			*cfg.stats = *stats
+		}()
+	}
+	if err := ctx.Err(); err != nil {
+		return diff, t.decodeError(err, diff)
+	}
+	if occupied == 0 {
 		return diff, nil
 	}
 
-	pure := queue.New()
-	err := t.enqueuePure(pure)
-	if err != nil {
-		return diff, err
+	// buckets that may be pure, a bucket is only examined again once peeling
+	// an item touched it, so decoding is linear in the buckets and items
+	var work []uint
+	for i, bkt := range t.buckets {
+		if bkt == nil {
+			continue
+		}
+		if bkt.count > stats.MaxCount {
+			stats.MaxCount = bkt.count
+		} else if -bkt.count > stats.MaxCount {
+			stats.MaxCount = -bkt.count
+		}
+		if bkt.pure() {
+			work = append(work, uint(i))
+		}
 	}
-	// ensure we have at least one pure bucket in the IBLT
-	// this is necessary condition for decoding an IBLT
-	if pure.Len() == 0 {
-		return diff, errors.New("no pure buckets in table")
-	}
-
-	bkt := NewBucket(t.dataLen, t.hashLen)
-	for pure.Len() > 0 {
-		// clean out pure queue, delete all pure buckets and output the stored data
-		// it will create more pure buckets to decode in the next cycle
-		for pure.Len() > 0 {
-			bkt = pure.Dequeue().(*Bucket)
-			if err = diff.encode(bkt); err != nil {
-				return diff, nil
+	// the worklist is first in first out, the items of a round end at
+	// roundEnd
+	roundEnd, round := len(work), 1
+
+	for ; len(work) > 0; stats.Iterations++ {
+		if cfg.maxIterations > 0 && stats.Iterations >= cfg.maxIterations {
+			return diff, t.decodeError(ErrMaxIterations, diff)
+		}
+		if stats.Iterations%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return diff, t.decodeError(err, diff)
+			}
+		}
+		if stats.Iterations == roundEnd {
+			round++
+			roundEnd += len(work)
+		}
+
+		i := work[0]
+		work = work[1:]
+		// look the bucket up again, it may have been copied on write or
+		// changed since it was added
+		bkt := t.buckets[i]
+		if !bkt.pure() {
+			continue
+		}
+		stats.PureCells++
+		stats.Rounds = round
+		d := make([]byte, len(bkt.dataSum))
+		copy(d, bkt.dataSum)
+		step := PeelStep{Round: round, Bucket: i, Item: d, Alpha: bkt.count == 1}
+		idxs := indexes(d, t.bktNum, t.hashNum)
+		if !containsIndex(idxs, i) {
+			stats.FalsePure++
+			t.observePeel(step, RejectedFalsePure)
+			continue
+		}
+		// an item backed out of diff, peeling it would only bring the
+		// table back to the state that produced it
+		if diff.backedOut.test(d) {
+			t.observePeel(step, SkippedBackedOut)
+			continue
+		}
+
+		// past the item limit only items backed out of the other side peel
+		if cfg.maxItems > 0 && diff.AlphaLen()+diff.BetaLen() >= cfg.maxItems {
+			other := diff.beta
+			if bkt.count != 1 {
+				other = diff.alpha
 			}
-			// Insert if count < 0, Delete if count > 0
-			if err = t.operate(bkt.dataSum, bkt.count < 0); err != nil {
-				return diff, err
+			if !other.test(d) {
+				return diff, t.decodeError(ErrMaxItems, diff)
 			}
 		}
-		// now pure queue should be empty, enqueue more pure cell
-		err = t.enqueuePure(pure)
-		if err != nil {
+
+		result := Peeled
+		// a false pure bucket peeled a bogus item earlier, the same item
+		// now comes back with the opposite sign. encode has backed it out
+		// of the diff and peeling it again restores the table.
+		if err := diff.encode(bkt); errors.Is(err, ErrRepetitiveBytes) {
+			result = BackedOut
+		} else if err != nil {
 			return diff, err
 		}
-		// no more bucket is pure either
-		// 1) we have successfully decoded all the possible buckets and all the buckets should be empty
-		// 2) we have hash collision for more than two items
+		stats.Peeled++
+		t.observePeel(step, result)
+		// Insert if count < 0, Delete if count > 0
+		sign := bkt.count < 0
+		for _, j := range idxs {
+			t.operateBucket(j, d, sign)
+			if t.buckets[j].pure() {
+				work = append(work, j)
+			}
+		}
+	}
+	// ensure we had at least one pure bucket in the IBLT
+	// this is necessary condition for decoding an IBLT
+	if stats.Peeled == 0 {
+		return diff, t.decodeError(ErrNoPureBucket, diff)
 	}
 	// check if every bucket is empty
 	if !t.empty() {
-		return diff, errors.New("dirty entries remained")
+		return diff, t.decodeError(ErrDirtyEntries, diff)
+	}
+
+	if snapshot != nil && !snapshot.equal(diff.table(t)) {
+		return diff, t.decodeError(ErrVerification, diff)
 	}
 
 	return diff, nil
 }
 
+func (t Table) decodeError(err error, diff *Diff) *DecodeError {
+	return &DecodeError{
+		Err:        err,
+		Recovered:  diff.AlphaLen() + diff.BetaLen(),
+		Residual:   t.residual(),
+		Collisions: diff.Collisions(),
+	}
+}
+
+// equal compares bucket contents, a nil bucket equals an empty one
+func (t Table) equal(a *Table) bool {
+	if t.check(a) != nil {
+		return false
+	}
+
+	for i := range t.buckets {
+		x, y := t.buckets[i], a.buckets[i]
+		switch {
+		case x == nil && y == nil:
+		case x == nil:
+			if !y.empty() {
+				return false
+			}
+		case y == nil:
+			if !x.empty() {
+				return false
+			}
+		default:
+			if x.count != y.count || !bytes.Equal(x.dataSum, y.dataSum) || !bytes.Equal(x.hashSum, y.hashSum) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (t Table) empty() bool {
 	for i := range t.buckets {
 		if t.buckets[i] != nil && !t.buckets[i].empty() {
@@ -177,58 +435,67 @@ func (t Table) empty() bool {
 	return true
 }
 
-func (t *Table) enqueuePure(pure *queue.Queue) error {
-	// TODO: mark empty bucket and skip early
-	pureMask := bitset.New(t.bitsSet.Len())
+// number of non-empty buckets
+func (t Table) residual() int {
+	n := 0
 	for i := range t.buckets {
-		// skip the same pure bucket at difference indexes, enqueue the first one
-		if t.buckets[i] != nil && !pureMask.Test(uint(i)) && t.buckets[i].pure() {
-			if err := t.index(t.buckets[i].dataSum); err != nil {
-				return err
-			}
-			if !t.bitsSet.Test(uint(i)) {
-				// current bucket is a false pure
-				continue
-			}
-			pureMask.InPlaceUnion(t.bitsSet)
-			pure.Enqueue(t.buckets[i])
+		if t.buckets[i] != nil && !t.buckets[i].empty() {
+			n++
 		}
 	}
-	return nil
+	return n
 }
 
 func (t Table) check(a *Table) error {
 	if t.bktNum != a.bktNum {
-		return errors.New("subtract table mismatches bucket number")
+		return &ParamMismatchError{"bucket number", int(t.bktNum), int(a.bktNum)}
 	}
 
 	if t.dataLen != a.dataLen {
-		return errors.New("subtract table mismatches data length")
+		return &ParamMismatchError{"data length", t.dataLen, a.dataLen}
 	}
 
 	if t.hashLen != a.hashLen {
-		return errors.New("subtract table mismatches hash length")
+		return &ParamMismatchError{"hash length", t.hashLen, a.hashLen}
+	}
+
+	if t.hashBits != a.hashBits {
+		return &ParamMismatchError{"checksum bits", t.hashBits, a.hashBits}
+	}
+
+	if t.countBits != a.countBits {
+		return &ParamMismatchError{"count bits", t.countBits, a.countBits}
 	}
 
 	if t.hashNum != a.hashNum {
-		return errors.New("subtract table mismatches number of hash functions")
+		return &ParamMismatchError{"number of hash functions", t.hashNum, a.hashNum}
 	}
 
+	// illegally appended buckets
 	if len(t.buckets) != len(a.buckets) {
-		return errors.New("illegally appended buckets")
+		return &ParamMismatchError{"buckets length", len(t.buckets), len(a.buckets)}
 	}
 
 	return nil
 }
 
 func (t *Table) operateBucket(idx uint, d []byte, sign bool) {
-	if t.buckets[idx] == nil {
-		t.buckets[idx] = NewBucket(t.dataLen, t.hashLen)
-	}
-	t.buckets[idx].operate(d, sign)
+	t.writable(idx).operate(d, sign)
 }
 
-func (t Table) Serialize() ([]byte, error) {
+// SerializeLegacy writes the format of the first releases, four uint16
+// parameters then the non-empty buckets, for peers that cannot read the
+// frame written by Serialize. It fails for packed tables and for tables
+// with more than 65535 buckets or counts outside the int16 range.
+func (t Table) SerializeLegacy() ([]byte, error) {
+	if t.packed() {
+		return nil, fmt.Errorf("%w: packed tables have no legacy format", ErrFormatLimit)
+	}
+	if t.bktNum > math.MaxUint16 || t.dataLen > math.MaxUint16 || t.hashNum > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: %d buckets of %d bytes and %d hash functions in the legacy format", ErrFormatLimit,
+			t.bktNum, t.dataLen, t.hashNum)
+	}
+
 	var buffer bytes.Buffer
 	twoBytes := make([]byte, 2)
 
@@ -239,6 +506,9 @@ func (t Table) Serialize() ([]byte, error) {
 
 	for idx, bkt := range t.buckets {
 		if bkt != nil && !bkt.empty() {
+			if bkt.count < math.MinInt16 || bkt.count > math.MaxInt16 {
+				return nil, fmt.Errorf("%w: count %d of bucket %d in the legacy format", ErrFormatLimit, bkt.count, idx)
+			}
 			binary.BigEndian.PutUint16(twoBytes, uint16(idx))
 			buffer.Write(twoBytes)
 			binary.BigEndian.PutUint16(twoBytes, uint16(bkt.count))
@@ -251,22 +521,51 @@ func (t Table) Serialize() ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-func Deserialize(b []byte) (*Table, error) {
-	reader := bytes.NewBuffer(b)
+// the four uint16 parameters of SerializeLegacy
+const legacyHeader = 8
 
-	bktNum := uint(binary.BigEndian.Uint16(reader.Next(2)))
-	dataLen := int(binary.BigEndian.Uint16(reader.Next(2)))
-	hashLen := int(binary.BigEndian.Uint16(reader.Next(2)))
-	hashNum := int(binary.BigEndian.Uint16(reader.Next(2)))
+func deserializeLegacy(b []byte) (*Table, error) {
+	if len(b) < legacyHeader {
+		return nil, ErrCorrupt
+	}
+	bktNum := uint(binary.BigEndian.Uint16(b))
+	dataLen := int(binary.BigEndian.Uint16(b[2:]))
+	hashLen := int(binary.BigEndian.Uint16(b[4:]))
+	hashNum := int(binary.BigEndian.Uint16(b[6:]))
+	b = b[legacyHeader:]
+	if err := checkShape(bktNum, hashNum); err != nil {
+		return nil, err
+	}
+	if hashLen < 1 || hashLen > maxHashBits/8 {
+		return nil, ErrCorrupt
+	}
 
+	// index, count, data and checksum
+	cellLen := 4 + dataLen + hashLen
+	if len(b)%cellLen != 0 {
+		return nil, ErrCorrupt
+	}
 	table := NewTable(bktNum, dataLen, hashLen, hashNum)
-	for next := reader.Next(2); len(next) != 0; next = reader.Next(2) {
-		idx := binary.BigEndian.Uint16(next)
-		table.buckets[idx] = NewBucket(dataLen, hashLen)
-		table.buckets[idx].count = int(int16(binary.BigEndian.Uint16(reader.Next(2))))
-		copy(table.buckets[idx].dataSum, reader.Next(dataLen))
-		copy(table.buckets[idx].hashSum, reader.Next(hashLen))
+	for ; len(b) > 0; b = b[cellLen:] {
+		idx := uint(binary.BigEndian.Uint16(b))
+		if idx >= bktNum {
+			return nil, ErrCorrupt
+		}
+		bkt := table.newBucket()
+		bkt.count = int(int16(binary.BigEndian.Uint16(b[2:])))
+		copy(bkt.dataSum, b[4:4+dataLen])
+		copy(bkt.hashSum, b[4+dataLen:cellLen])
+		table.buckets[idx] = bkt
 	}
 
 	return table, nil
 }
+
+// checkShape rejects bucket and hash function numbers no constructor
+// accepts, indexes cannot find more distinct buckets than there are
+func checkShape(bktNum uint, hashNum int) error {
+	if bktNum == 0 || hashNum < 1 || uint(hashNum) > bktNum {
+		return ErrCorrupt
+	}
+	return nil
+}
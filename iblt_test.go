@@ -2,6 +2,9 @@ package iblt
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -28,14 +31,27 @@ var tests = []struct {
 	{4, 1, 4, 1024, 200, 400, 1000},
 }
 
+var seedFlag = flag.Int64("seed", 0, "seed of the random tests, 0 picks one from the clock")
+
+// testRand returns the source of random items of a test and logs its seed,
+// rerun a failed test with -seed to reproduce it
+func testRand(t testing.TB) *rand.Rand {
+	seed := *seedFlag
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", seed)
+	return rand.New(rand.NewSource(seed))
+}
+
 func TestTable_Insert(t *testing.T) {
-	rand.Seed(time.Now().Unix())
+	r := testRand(t)
 
 	for _, test := range tests {
 		b := make([]byte, test.dataLen)
 		table := NewTable(test.bktNum, test.dataLen, test.hashLen, test.hashNum)
 		for i := 0; i < test.alphaItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := table.Insert(b); err != nil {
 				t.Errorf("test Insert failed error: %v", err)
 			}
@@ -55,29 +71,28 @@ func TestTable_Insert(t *testing.T) {
 
 // IBLT subtract IBLT then decode
 func TestTable_Decode(t *testing.T) {
-	seed := time.Now().Unix()
-	rand.Seed(seed)
+	r := testRand(t)
 
 	for _, test := range tests {
 		alphaTable := NewTable(test.bktNum, test.dataLen, test.hashLen, test.hashNum)
 		betaTable := NewTable(test.bktNum, test.dataLen, test.hashLen, test.hashNum)
 		b := make([]byte, test.dataLen)
 		for i := 0; i < test.alphaItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := alphaTable.Insert(b); err != nil {
 				t.Errorf("test Insert failed error: %v", err)
 			}
 		}
 
 		for i := 0; i < test.betaItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := betaTable.Insert(b); err != nil {
 				t.Errorf("test Insert failed error: %v", err)
 			}
 		}
 
 		for i := 0; i < test.sharedItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := alphaTable.Insert(b); err != nil {
 				t.Errorf("test Insert failed error: %v", err)
 			}
@@ -106,26 +121,25 @@ func TestTable_Decode(t *testing.T) {
 
 // construct IBLT and delete one by one and decode
 func TestTable_Delete(t *testing.T) {
-	seed := time.Now().Unix()
-	rand.Seed(seed)
+	r := testRand(t)
 
 	for _, test := range tests {
 		table := NewTable(test.bktNum, test.dataLen, test.hashLen, test.hashNum)
 		b := make([]byte, test.dataLen)
 		for i := 0; i < test.alphaItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := table.Insert(b); err != nil {
 				t.Errorf("test Insert failed error: %v", err)
 			}
 		}
 		for i := 0; i < test.betaItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := table.Delete(b); err != nil {
 				t.Errorf("test Delete failed error: %v", err)
 			}
 		}
 		for i := 0; i < test.sharedItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := table.Insert(b); err != nil {
 				t.Errorf("test Insert failed error: %v", err)
 			}
@@ -150,20 +164,19 @@ func TestTable_Delete(t *testing.T) {
 }
 
 func TestTableEncodeDecode(t *testing.T) {
-	seed := time.Now().Unix()
-	rand.Seed(seed)
+	r := testRand(t)
 
 	for _, test := range tests {
 		table := NewTable(test.bktNum, test.dataLen, test.hashLen, test.hashNum)
 		b := make([]byte, test.dataLen)
 		for i := 0; i < test.alphaItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := table.Insert(b); err != nil {
 				t.Errorf("test Insert failed error: %v", err)
 			}
 		}
 		for i := 0; i < test.betaItems; i ++ {
-			rand.Read(b)
+			r.Read(b)
 			if err := table.Delete(b); err != nil {
 				t.Errorf("test Delete failed error: %v", err)
 			}
@@ -217,3 +230,257 @@ func TestTableEncodeDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestTableErrors(t *testing.T) {
+	r := testRand(t)
+
+	table := NewTable(80, 4, 1, 4)
+	if err := table.Insert(make([]byte, 5)); !errors.Is(err, ErrDataLength) {
+		t.Errorf("insert error want %v, get %v", ErrDataLength, err)
+	}
+
+	err := table.Subtract(NewTable(80, 4, 2, 4))
+	if !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("subtract error want %v, get %v", ErrParamMismatch, err)
+	}
+	var mismatch *ParamMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("subtract error is not a *ParamMismatchError: %v", err)
+	}
+	if mismatch.Param != "hash length" || mismatch.Want != 1 || mismatch.Got != 2 {
+		t.Errorf("unexpected mismatch %+v", mismatch)
+	}
+
+	// far more items than buckets cannot be peeled
+	b := make([]byte, 4)
+	for i := 0; i < 200; i++ {
+		r.Read(b)
+		if err := table.Insert(b); err != nil {
+			t.Errorf("test Insert failed error: %v", err)
+		}
+	}
+	_, err = table.Decode()
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("decode error is not a *DecodeError: %v", err)
+	}
+	if !errors.Is(err, ErrNoPureBucket) && !errors.Is(err, ErrDirtyEntries) {
+		t.Errorf("decode error does not wrap a decode sentinel: %v", err)
+	}
+	if decodeErr.Residual == 0 {
+		t.Errorf("decode error reports no residual buckets: %v", err)
+	}
+}
+
+func TestTableDecodeCollision(t *testing.T) {
+	// with 1 byte items and checksums the bucket holding 1, 76 and -186 looks
+	// pure, its data sum 1^76^186 is peeled as a bogus item first
+	table := NewTable(8, 1, 1, 2)
+	for _, b := range []byte{1, 76} {
+		if err := table.Insert([]byte{b}); err != nil {
+			t.Errorf("test Insert failed error: %v", err)
+		}
+	}
+	if err := table.Delete([]byte{186}); err != nil {
+		t.Errorf("test Delete failed error: %v", err)
+	}
+
+	diff, err := table.Decode(WithVerify())
+	if err != nil {
+		t.Fatalf("test Decode failed error: %v", err)
+	}
+	if diff.Collisions() == 0 {
+		t.Error("collision not reported")
+	}
+	if !reflect.DeepEqual(diff.AlphaSlice(), [][]byte{{1}, {76}}) && !reflect.DeepEqual(diff.AlphaSlice(), [][]byte{{76}, {1}}) {
+		t.Errorf("alpha mismatch want [[1] [76]], get %v", diff.AlphaSlice())
+	}
+	if !reflect.DeepEqual(diff.BetaSlice(), [][]byte{{186}}) {
+		t.Errorf("beta mismatch want [[186]], get %v", diff.BetaSlice())
+	}
+}
+
+func TestTableDecodeVerify(t *testing.T) {
+	r := testRand(t)
+
+	for _, test := range tests {
+		table := NewTable(test.bktNum, test.dataLen, test.hashLen, test.hashNum)
+		b := make([]byte, test.dataLen)
+		for i := 0; i < test.alphaItems; i++ {
+			r.Read(b)
+			if err := table.Insert(b); err != nil {
+				t.Errorf("test Insert failed error: %v", err)
+			}
+		}
+		for i := 0; i < test.betaItems; i++ {
+			r.Read(b)
+			if err := table.Delete(b); err != nil {
+				t.Errorf("test Delete failed error: %v", err)
+			}
+		}
+
+		diff, err := table.Decode(WithVerify())
+		if errors.Is(err, ErrDirtyEntries) {
+			// 50 items in 80 buckets fail to peel for about 2% of seeds and
+			// the other cases for a few in a thousand, this test is about
+			// verification failing tables that did peel
+			t.Logf("test Decode stalled: %v, case: %v", err, test)
+			continue
+		}
+		if err != nil {
+			t.Errorf("test Decode failed error: %v, case: %v", err, test)
+		}
+		if diff.AlphaLen() != test.alphaItems || diff.BetaLen() != test.betaItems {
+			t.Errorf("decode diff number mismatched want %d/%d, get %d/%d, case: %v",
+				test.alphaItems, test.betaItems, diff.AlphaLen(), diff.BetaLen(), test)
+		}
+	}
+}
+
+func TestTableDecodeContext(t *testing.T) {
+	r := testRand(t)
+
+	table := NewTable(1024, 8, 1, 4)
+	b := make([]byte, 8)
+	for i := 0; i < 300; i++ {
+		r.Read(b)
+		table.Insert(b)
+	}
+
+	var decodeErr *DecodeError
+	diff, err := table.Copy().Decode(WithMaxItems(100))
+	if !errors.Is(err, ErrMaxItems) || !errors.As(err, &decodeErr) {
+		t.Errorf("decode error want %v, get %v", ErrMaxItems, err)
+	} else if diff.AlphaLen() != 100 || decodeErr.Recovered != 100 {
+		t.Errorf("partial diff want 100 items, get %d", diff.AlphaLen())
+	}
+
+	diff, err = table.Copy().Decode(WithMaxIterations(50))
+	if !errors.Is(err, ErrMaxIterations) {
+		t.Errorf("decode error want %v, get %v", ErrMaxIterations, err)
+	} else if diff.AlphaLen() > 50 {
+		t.Errorf("partial diff want at most 50 items, get %d", diff.AlphaLen())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := table.Copy().DecodeContext(ctx); !errors.Is(err, context.Canceled) || !errors.As(err, &decodeErr) {
+		t.Errorf("decode error want %v, get %v", context.Canceled, err)
+	}
+
+	// limits above the difference change nothing
+	diff, err = table.DecodeContext(context.Background(), WithMaxItems(300), WithMaxIterations(10000))
+	if err != nil || diff.AlphaLen() != 300 {
+		t.Errorf("decode error: %v, %d items", err, diff.AlphaLen())
+	}
+}
+
+func TestNewTable(t *testing.T) {
+	// indexes would look for distinct buckets forever
+	for _, c := range []struct {
+		buckets uint
+		hashLen int
+		hashNum int
+	}{
+		{0, 1, 1},
+		{2, 1, 3},
+		{8, 1, 0},
+		{8, 0, 2},
+		{8, 9, 2},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewTable(%d, 8, %d, %d) does not panic", c.buckets, c.hashLen, c.hashNum)
+				}
+			}()
+			NewTable(c.buckets, 8, c.hashLen, c.hashNum)
+		}()
+	}
+}
+
+func TestTableCopy(t *testing.T) {
+	r := testRand(t)
+
+	for _, test := range tests {
+		table := NewTable(test.bktNum, test.dataLen, test.hashLen, test.hashNum)
+		b := make([]byte, test.dataLen)
+		for i := 0; i < test.alphaItems; i++ {
+			r.Read(b)
+			if err := table.Insert(b); err != nil {
+				t.Errorf("test Insert failed error: %v", err)
+			}
+		}
+		want, err := table.Serialize()
+		if err != nil {
+			t.Fatalf("table serialize error %v", err)
+		}
+
+		for name, cpy := range map[string]*Table{"copy": table.Copy(), "snapshot": table.Snapshot()} {
+			r.Read(b)
+			if err := cpy.Insert(b); err != nil {
+				t.Errorf("test Insert failed error: %v", err)
+			}
+			if err := cpy.Delete(b); err != nil {
+				t.Errorf("test Delete failed error: %v", err)
+			}
+			// a few seeds fail to peel, 40 items in 80 buckets most often,
+			// the copy is then left partially peeled, which must not reach
+			// table either
+			if _, err := cpy.Decode(); errors.Is(err, ErrDirtyEntries) {
+				t.Logf("test Decode of %s stalled: %v, case: %v", name, err, test)
+			} else if err != nil {
+				t.Errorf("test Decode of %s failed error: %v, case: %v", name, err, test)
+			} else if !cpy.empty() {
+				t.Errorf("decoded %s is not empty", name)
+			}
+
+			get, err := table.Serialize()
+			if err != nil {
+				t.Fatalf("table serialize error %v", err)
+			}
+			if !bytes.Equal(get, want) {
+				t.Errorf("decoding %s modified the original, case: %v", name, test)
+			}
+		}
+
+		// the other way around, modifying the original leaves a snapshot intact
+		snapshot := table.Snapshot()
+		if _, err := table.Decode(); err != nil && !errors.Is(err, ErrDirtyEntries) {
+			t.Errorf("test Decode failed error: %v, case: %v", err, test)
+		}
+		get, err := snapshot.Serialize()
+		if err != nil {
+			t.Fatalf("table serialize error %v", err)
+		}
+		if !bytes.Equal(get, want) {
+			t.Errorf("decoding the original modified its snapshot, case: %v", test)
+		}
+	}
+}
+
+func TestByteSet(t *testing.T) {
+	s := newByteSet(0)
+	for _, b := range [][]byte{{1}, {2}, {3}, {2}} {
+		s.insert(b)
+	}
+	if s.len() != 3 {
+		t.Fatalf("set length want 3, get %d", s.len())
+	}
+
+	// deleting an absent item leaves the set untouched
+	s.delete([]byte{4})
+	if !reflect.DeepEqual(s.slice(), [][]byte{{1}, {2}, {3}}) {
+		t.Errorf("absent delete modified set %v", s.slice())
+	}
+
+	s.delete([]byte{1})
+	if s.test([]byte{1}) || !s.test([]byte{2}) || !s.test([]byte{3}) || s.len() != 2 {
+		t.Errorf("unexpected set after delete %v", s.slice())
+	}
+	s.delete([]byte{3})
+	s.delete([]byte{2})
+	if s.len() != 0 || len(s.index) != 0 {
+		t.Errorf("set not empty after deleting everything %v", s.slice())
+	}
+}
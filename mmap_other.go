@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+
+package iblt
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoMmap = errors.New("persistent tables are not supported on this platform")
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, errNoMmap
+}
+
+func munmap(b []byte) error {
+	return errNoMmap
+}
+
+func msync(b []byte) error {
+	return errNoMmap
+}
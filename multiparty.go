@@ -0,0 +1,178 @@
+package iblt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Topology picks which pairs of peers a Coordinator subtracts and decodes
+type Topology int
+
+const (
+	// Star decodes every peer against the first one added, N-1 decodes.
+	// A peer whose difference to the first fails to decode stays unknown.
+	Star Topology = iota
+	// Pairwise decodes every pair of peers, N(N-1)/2 decodes. Statuses
+	// carry over pairs that decoded, so a failed pair rarely leaves an
+	// item unknown.
+	Pairwise
+)
+
+// Coordinator reconciles the tables of more than two peers in one round,
+// telling for every item in any difference which peers have it.
+type Coordinator struct {
+	peers  []string
+	tables []*Table
+}
+
+func NewCoordinator() *Coordinator {
+	return &Coordinator{}
+}
+
+// AddPeer registers the table of a peer, every table must share parameters
+func (c *Coordinator) AddPeer(id string, t *Table) error {
+	for _, peer := range c.peers {
+		if peer == id {
+			return fmt.Errorf("%w: peer %s", ErrDuplicate, id)
+		}
+	}
+	if len(c.tables) > 0 {
+		if err := c.tables[0].check(t); err != nil {
+			return err
+		}
+	}
+
+	c.peers = append(c.peers, id)
+	c.tables = append(c.tables, t)
+	return nil
+}
+
+// Presence tells which peers have an item and which lack it. Unknown
+// peers only decoded against peers in failed pairs.
+type Presence struct {
+	Item    []byte
+	Have    []string
+	Lack    []string
+	Unknown []string
+}
+
+// Reconciliation holds every item not held by all peers, sorted by item
+type Reconciliation struct {
+	Items []Presence
+}
+
+// Missing lists the items a peer lacks, to be fetched from a peer in Have
+func (r Reconciliation) Missing(peer string) [][]byte {
+	var rtn [][]byte
+	for _, p := range r.Items {
+		for _, id := range p.Lack {
+			if id == peer {
+				rtn = append(rtn, p.Item)
+				break
+			}
+		}
+	}
+	return rtn
+}
+
+// status of an item at a peer
+const (
+	unknown = iota
+	have
+	lack
+)
+
+// Reconcile decodes the differences chosen by topology. The tables added are
+// left untouched. If some pairs fail to decode the Reconciliation is still
+// returned, with the peers it could not resolve as Unknown, along with a
+// *PairError.
+func (c *Coordinator) Reconcile(topology Topology, opts ...DecodeOption) (*Reconciliation, error) {
+	var pairs [][2]int
+	for i := range c.peers {
+		for j := i + 1; j < len(c.peers); j++ {
+			if topology == Pairwise || i == 0 {
+				pairs = append(pairs, [2]int{i, j})
+			}
+		}
+	}
+
+	// status by item, then by peer
+	status := make(map[string][]int)
+	mark := func(b []byte, peer int, s int) {
+		st, ok := status[string(b)]
+		if !ok {
+			st = make([]int, len(c.peers))
+			status[string(b)] = st
+		}
+		st[peer] = s
+	}
+
+	var pairErr *PairError
+	var decoded [][2]int
+	for _, pair := range pairs {
+		// the peers' observers are not told of a scratch table
+		t := c.tables[pair[0]].Copy()
+		t.SetObserver(nil)
+		if err := t.Subtract(c.tables[pair[1]]); err != nil {
+			return nil, err
+		}
+		diff, err := t.Decode(opts...)
+		if err != nil {
+			if pairErr == nil {
+				pairErr = &PairError{}
+			}
+			pairErr.Pairs = append(pairErr.Pairs, [2]string{c.peers[pair[0]], c.peers[pair[1]]})
+			pairErr.Errs = append(pairErr.Errs, err)
+			continue
+		}
+		decoded = append(decoded, pair)
+		for _, b := range diff.AlphaSlice() {
+			mark(b, pair[0], have)
+			mark(b, pair[1], lack)
+		}
+		for _, b := range diff.BetaSlice() {
+			mark(b, pair[0], lack)
+			mark(b, pair[1], have)
+		}
+	}
+
+	rtn := &Reconciliation{}
+	for item, st := range status {
+		// an item outside the difference of a decoded pair has the same
+		// status at both peers, spread known statuses along those pairs
+		for changed := true; changed; {
+			changed = false
+			for _, pair := range decoded {
+				i, j := pair[0], pair[1]
+				if st[i] == unknown && st[j] != unknown {
+					st[i], changed = st[j], true
+				}
+				if st[j] == unknown && st[i] != unknown {
+					st[j], changed = st[i], true
+				}
+			}
+		}
+
+		p := Presence{Item: []byte(item)}
+		for peer, s := range st {
+			switch s {
+			case have:
+				p.Have = append(p.Have, c.peers[peer])
+			case lack:
+				p.Lack = append(p.Lack, c.peers[peer])
+			default:
+				p.Unknown = append(p.Unknown, c.peers[peer])
+			}
+		}
+		rtn.Items = append(rtn.Items, p)
+	}
+	sort.Slice(rtn.Items, func(i, j int) bool {
+		return bytes.Compare(rtn.Items[i].Item, rtn.Items[j].Item) < 0
+	})
+
+	if pairErr != nil {
+		return rtn, pairErr
+	}
+	return rtn, nil
+}
@@ -0,0 +1,135 @@
+package iblt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCoordinator_Reconcile(t *testing.T) {
+	rng := testRand(t)
+
+	peers := []string{"a", "b", "c", "d", "e"}
+	sets := make(map[string]testSet)
+	for _, id := range peers {
+		sets[id] = testSet{}
+	}
+	// a shared base each peer misses a few items of, plus a few own items
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, 8)
+		rng.Read(b)
+		for _, id := range peers {
+			if rng.Intn(100) != 0 {
+				sets[id].Insert(b)
+			}
+		}
+	}
+	for _, id := range peers {
+		for i := 0; i < 5; i++ {
+			b := make([]byte, 8)
+			rng.Read(b)
+			sets[id].Insert(b)
+		}
+	}
+
+	c := NewCoordinator()
+	for _, id := range peers {
+		table := NewTable(256, 8, 1, 4)
+		for b := range sets[id] {
+			table.Insert([]byte(b))
+		}
+		if err := c.AddPeer(id, table); err != nil {
+			t.Fatalf("add peer error: %v", err)
+		}
+	}
+	if err := c.AddPeer("a", NewTable(256, 8, 1, 4)); !errors.Is(err, ErrDuplicate) {
+		t.Error("peer added twice")
+	}
+	if err := c.AddPeer("f", NewTable(128, 8, 1, 4)); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("add peer error want %v, get %v", ErrParamMismatch, err)
+	}
+
+	for _, topology := range []Topology{Star, Pairwise} {
+		r, err := c.Reconcile(topology)
+		if err != nil {
+			t.Fatalf("reconcile error: %v, topology %d", err, topology)
+		}
+		if len(r.Items) == 0 {
+			t.Fatal("no differing items")
+		}
+		for _, p := range r.Items {
+			var have, lack []string
+			for _, id := range peers {
+				if sets[id][string(p.Item)] {
+					have = append(have, id)
+				} else {
+					lack = append(lack, id)
+				}
+			}
+			if !reflect.DeepEqual(p.Have, have) || !reflect.DeepEqual(p.Lack, lack) || len(p.Unknown) != 0 {
+				t.Errorf("item %x want have %v lack %v, get %+v, topology %d", p.Item, have, lack, p, topology)
+			}
+		}
+
+		// every peer converges once it fetches what it misses
+		for _, id := range peers {
+			for _, b := range r.Missing(id) {
+				sets[id].Insert(b)
+			}
+		}
+		for _, id := range peers[1:] {
+			if !reflect.DeepEqual(sets[id].sorted(), sets[peers[0]].sorted()) {
+				t.Errorf("peer %s did not converge, topology %d", id, topology)
+			}
+		}
+		for _, id := range peers {
+			for _, b := range r.Missing(id) {
+				sets[id].Delete(b)
+			}
+		}
+	}
+}
+
+func TestCoordinator_Failure(t *testing.T) {
+	rng := testRand(t)
+
+	c := NewCoordinator()
+	small := NewTable(64, 8, 1, 4)
+	b := make([]byte, 8)
+	for _, id := range []string{"a", "b", "c"} {
+		table := NewTable(64, 8, 1, 4)
+		if id != "c" {
+			rng.Read(b)
+			table.Insert(b)
+		}
+		c.AddPeer(id, table)
+	}
+	// peer d holds far more than the tables can tell apart
+	for i := 0; i < 200; i++ {
+		rng.Read(b)
+		small.Insert(b)
+	}
+	c.AddPeer("d", small)
+
+	for _, topology := range []Topology{Star, Pairwise} {
+		r, err := c.Reconcile(topology)
+		var pairErr *PairError
+		if !errors.As(err, &pairErr) {
+			t.Fatalf("reconcile error is not a *PairError: %v", err)
+		}
+		for _, pair := range pairErr.Pairs {
+			if pair[1] != "d" {
+				t.Errorf("unexpected failed pair %v", pair)
+			}
+		}
+		// the items of a and b are resolved for everyone but d
+		if len(r.Items) != 2 {
+			t.Fatalf("want 2 items, get %d", len(r.Items))
+		}
+		for _, p := range r.Items {
+			if !reflect.DeepEqual(p.Unknown, []string{"d"}) || len(p.Have) != 1 || len(p.Lack) != 2 {
+				t.Errorf("unexpected presence %+v, topology %d", p, topology)
+			}
+		}
+	}
+}
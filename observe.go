@@ -0,0 +1,77 @@
+package iblt
+
+// DecodeStats describes a single decode, filled by the WithStats option
+// whether decoding succeeded or not
+type DecodeStats struct {
+	// peeling rounds, items of round n+1 only became pure by peeling the
+	// items of round n
+	Rounds int
+	// peeling steps taken, bounded by WithMaxIterations
+	Iterations int
+	// buckets found pure by count and checksum
+	PureCells int
+	// pure buckets rejected by the index membership check
+	FalsePure int
+	// items peeled, including bogus items backed out later
+	Peeled int
+	// bogus items backed out of the diff
+	Collisions int
+	// non-empty buckets left when decoding stopped
+	Residual int
+	// largest absolute bucket count before decoding
+	MaxCount int
+}
+
+// WithStats fills s with statistics of the decode
+func WithStats(s *DecodeStats) DecodeOption {
+	return func(c *decodeConfig) {
+		c.stats = s
+	}
+}
+
+// PeelResult tells what a peeling step did with a pure bucket
+type PeelResult int
+
+const (
+	// the item was decoded and removed from the table
+	Peeled PeelResult = iota
+	// the bucket is not one of the buckets of its data sum
+	RejectedFalsePure
+	// the item was backed out of the diff earlier and is not peeled again
+	SkippedBackedOut
+	// the item was already on the other side of the diff, it was backed out
+	// of the diff and removed from the table
+	BackedOut
+)
+
+// PeelStep is a peeling step on a pure bucket
+type PeelStep struct {
+	Round  int
+	Bucket uint
+	// copy of the data sum of the bucket, not to be modified
+	Item   []byte
+	Alpha  bool
+	Result PeelResult
+}
+
+// Observer is notified of changes to a Table, to export metrics or trace
+// problem tables. Copies and snapshots of the table keep its observer.
+type Observer interface {
+	ObserveInsert(item []byte)
+	ObserveDelete(item []byte)
+	ObserveSubtract(a *Table)
+	ObserveAdd(a *Table)
+	ObservePeel(step PeelStep)
+}
+
+// SetObserver replaces the observer of t, nil removes it
+func (t *Table) SetObserver(o Observer) {
+	t.observer = o
+}
+
+func (t Table) observePeel(step PeelStep, result PeelResult) {
+	if t.observer != nil {
+		step.Result = result
+		t.observer.ObservePeel(step)
+	}
+}
@@ -0,0 +1,154 @@
+package iblt
+
+import (
+	"testing"
+)
+
+type recorder struct {
+	inserts, deletes, subtracts, adds int
+	steps                             []PeelStep
+}
+
+func (r *recorder) ObserveInsert(item []byte) {
+	r.inserts++
+}
+
+func (r *recorder) ObserveDelete(item []byte) {
+	r.deletes++
+}
+
+func (r *recorder) ObserveSubtract(a *Table) {
+	r.subtracts++
+}
+
+func (r *recorder) ObserveAdd(a *Table) {
+	r.adds++
+}
+
+func (r *recorder) ObservePeel(step PeelStep) {
+	r.steps = append(r.steps, step)
+}
+
+func TestTableObserver(t *testing.T) {
+	r := testRand(t)
+
+	rec := &recorder{}
+	alice := NewTable(256, 8, 1, 4)
+	alice.SetObserver(rec)
+	bob := NewTable(256, 8, 1, 4)
+	b := make([]byte, 8)
+	for i := 0; i < 60; i++ {
+		r.Read(b)
+		alice.Insert(b)
+	}
+	for i := 0; i < 40; i++ {
+		r.Read(b)
+		bob.Insert(b)
+	}
+	alice.Delete(b)
+	alice.Insert(b)
+	if err := alice.Subtract(bob); err != nil {
+		t.Fatalf("subtract error: %v", err)
+	}
+
+	var stats DecodeStats
+	diff, err := alice.Copy().Decode(WithStats(&stats), WithVerify())
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if rec.inserts != 61 || rec.deletes != 1 || rec.subtracts != 1 {
+		t.Errorf("observed inserts/deletes/subtracts want 61/1/1, get %d/%d/%d", rec.inserts, rec.deletes, rec.subtracts)
+	}
+
+	peeled := 0
+	for i, step := range rec.steps {
+		if i > 0 && step.Round < rec.steps[i-1].Round {
+			t.Errorf("step %d goes back to round %d", i, step.Round)
+		}
+		if step.Result == Peeled || step.Result == BackedOut {
+			peeled++
+		}
+		// the item outlives the bucket it was peeled from
+		if step.Result == Peeled && !diff.alpha.test(step.Item) && !diff.beta.test(step.Item) && !diff.backedOut.test(step.Item) {
+			t.Errorf("step %d peeled %x, not in the diff", i, step.Item)
+		}
+	}
+	if peeled != stats.Peeled || stats.Peeled != diff.AlphaLen()+diff.BetaLen()+2*diff.Collisions() {
+		t.Errorf("peeled want %d items, observed %d, stats %d", diff.AlphaLen()+diff.BetaLen(), peeled, stats.Peeled)
+	}
+	if stats.Rounds < 2 || stats.Rounds != rec.steps[len(rec.steps)-1].Round {
+		t.Errorf("rounds %d, last observed round %d", stats.Rounds, rec.steps[len(rec.steps)-1].Round)
+	}
+	// the worklist holds the buckets once and those a peel touched, linear
+	// in the buckets and items
+	if stats.Iterations > 256+4*stats.Peeled {
+		t.Errorf("%d iterations for %d peeled items", stats.Iterations, stats.Peeled)
+	}
+	if stats.Iterations < stats.PureCells || stats.PureCells < stats.Peeled+stats.FalsePure {
+		t.Errorf("inconsistent stats %+v", stats)
+	}
+	if stats.MaxCount < 2 || stats.Residual != 0 {
+		t.Errorf("stats max count %d, residual %d", stats.MaxCount, stats.Residual)
+	}
+
+	if err := alice.Add(bob); err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	if rec.adds != 1 {
+		t.Errorf("observed adds want 1, get %d", rec.adds)
+	}
+}
+
+func TestTableDecodeStats(t *testing.T) {
+	r := testRand(t)
+
+	// the table of TestTableDecodeCollision, a bogus item is backed out
+	table := NewTable(8, 1, 1, 2)
+	table.Insert([]byte{1})
+	table.Insert([]byte{76})
+	table.Delete([]byte{186})
+	var stats DecodeStats
+	if _, err := table.Decode(WithStats(&stats)); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if stats.Collisions != 1 || stats.Peeled != 5 {
+		t.Errorf("collisions/peeled want 1/5, get %d/%d", stats.Collisions, stats.Peeled)
+	}
+
+	// a table too full to decode leaves residual buckets
+	table = NewTable(64, 8, 1, 4)
+	b := make([]byte, 8)
+	for i := 0; i < 200; i++ {
+		r.Read(b)
+		table.Insert(b)
+	}
+	if _, err := table.Decode(WithStats(&stats)); err == nil {
+		t.Fatal("overloaded table decoded")
+	}
+	if stats.Residual == 0 || stats.MaxCount < 10 {
+		t.Errorf("stats residual %d, max count %d", stats.Residual, stats.MaxCount)
+	}
+}
+
+func TestCoordinatorObserver(t *testing.T) {
+	c := NewCoordinator()
+	recs := make(map[string]*recorder)
+	for i, id := range []string{"a", "b", "c"} {
+		recs[id] = &recorder{}
+		table := NewTable(64, 8, 1, 4)
+		table.SetObserver(recs[id])
+		table.Insert([]byte{byte(i), 1, 2, 3, 4, 5, 6, 7})
+		if err := c.AddPeer(id, table); err != nil {
+			t.Fatalf("add peer error: %v", err)
+		}
+	}
+	if _, err := c.Reconcile(Pairwise); err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	for id, rec := range recs {
+		if rec.inserts != 1 || rec.subtracts != 0 || len(rec.steps) != 0 {
+			t.Errorf("peer %s observed %d inserts, %d subtracts and %d peels of scratch tables",
+				id, rec.inserts, rec.subtracts, len(rec.steps))
+		}
+	}
+}
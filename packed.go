@@ -0,0 +1,117 @@
+package iblt
+
+const (
+	maxHashBits  = 64
+	maxCountBits = 16
+)
+
+// packedCells writes every bucket, empty ones included, as count, data and
+// checksum bits in a single bit stream. Tables for constrained links are
+// sized to the difference and mostly full, a per bucket index would cost
+// more than the empty buckets it saves.
+func (t Table) packedCells() []byte {
+	w := &bitWriter{}
+	for _, bkt := range t.buckets {
+		if bkt == nil {
+			bkt = t.newBucket()
+		}
+		w.write(uint64(bkt.count), t.countBits)
+		w.writeBytes(bkt.dataSum, t.dataLen*8)
+		w.writeBytes(bkt.hashSum, t.hashBits)
+	}
+	return w.bytes()
+}
+
+// readPackedCells fills the empty table t with what packedCells wrote
+func (t *Table) readPackedCells(b []byte) error {
+	cellBits := t.countBits + t.dataLen*8 + t.hashBits
+	if uint64(len(b)) != (uint64(t.bktNum)*uint64(cellBits)+7)/8 {
+		return ErrCorrupt
+	}
+	r := &bitReader{buf: b}
+	for i := range t.buckets {
+		bkt := t.newBucket()
+		bkt.count = int(r.read(t.countBits))
+		bkt.wrap()
+		r.readBytes(bkt.dataSum, t.dataLen*8)
+		r.readBytes(bkt.hashSum, t.hashBits)
+		if !bkt.empty() {
+			t.buckets[i] = bkt
+		}
+	}
+	return nil
+}
+
+// bitWriter appends values most significant bit first
+type bitWriter struct {
+	buf []byte
+	// bits used in the last byte of buf, 0 means it is full
+	used int
+}
+
+// write appends the low n bits of v
+func (w *bitWriter) write(v uint64, n int) {
+	for n > 0 {
+		if w.used == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		take := 8 - w.used
+		if take > n {
+			take = n
+		}
+		chunk := byte(v>>uint(n-take)) & byte(1<<uint(take)-1)
+		w.buf[len(w.buf)-1] |= chunk << uint(8-w.used-take)
+		w.used = (w.used + take) % 8
+		n -= take
+	}
+}
+
+// writeBytes appends the first n bits of b
+func (w *bitWriter) writeBytes(b []byte, n int) {
+	for _, v := range b {
+		if n >= 8 {
+			w.write(uint64(v), 8)
+		} else if n > 0 {
+			w.write(uint64(v>>uint(8-n)), n)
+		}
+		n -= 8
+	}
+}
+
+func (w bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// bitReader reads what bitWriter wrote, bounds checked by the caller
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) read(n int) uint64 {
+	var v uint64
+	for n > 0 {
+		used := r.pos % 8
+		take := 8 - used
+		if take > n {
+			take = n
+		}
+		chunk := r.buf[r.pos/8] >> uint(8-used-take) & byte(1<<uint(take)-1)
+		v = v<<uint(take) | uint64(chunk)
+		r.pos += take
+		n -= take
+	}
+	return v
+}
+
+// readBytes fills the first n bits of b, leaving the rest zero
+func (r *bitReader) readBytes(b []byte, n int) {
+	for i := range b {
+		if n >= 8 {
+			b[i] = byte(r.read(8))
+		} else if n > 0 {
+			b[i] = byte(r.read(n)) << uint(8-n)
+		}
+		n -= 8
+	}
+}
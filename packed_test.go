@@ -0,0 +1,133 @@
+package iblt
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBitWriter(t *testing.T) {
+	rng := testRand(t)
+
+	type field struct {
+		v uint64
+		n int
+	}
+	var fields []field
+	w := &bitWriter{}
+	bits := 0
+	for i := 0; i < 1000; i++ {
+		n := rng.Intn(64) + 1
+		v := rng.Uint64() & (1<<uint(n) - 1)
+		fields = append(fields, field{v, n})
+		w.write(v, n)
+		bits += n
+	}
+	if len(w.bytes()) != (bits+7)/8 {
+		t.Fatalf("written length want %d, get %d", (bits+7)/8, len(w.bytes()))
+	}
+	r := &bitReader{buf: w.bytes()}
+	for i, f := range fields {
+		if v := r.read(f.n); v != f.v {
+			t.Fatalf("field %d of %d bits want %x, get %x", i, f.n, f.v, v)
+		}
+	}
+}
+
+func TestPackedTable_Serialize(t *testing.T) {
+	r := testRand(t)
+
+	table, err := NewPackedTable(200, 8, 4, 3, 3)
+	if err != nil {
+		t.Fatalf("new packed table error: %v", err)
+	}
+	b := make([]byte, 8)
+	for i := 0; i < 500; i++ {
+		r.Read(b)
+		table.Insert(b)
+	}
+
+	ser, err := table.Serialize()
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	// frame, then 3+64+4 bits a bucket
+	if want := frameHeader + frameTrailer + (200*71+7)/8; len(ser) != want {
+		t.Errorf("serialized length want %d, get %d", want, len(ser))
+	}
+	got, err := Deserialize(ser)
+	if err != nil {
+		t.Fatalf("deserialize error: %v", err)
+	}
+	if !table.equal(got) {
+		t.Error("deserialized table mismatches")
+	}
+
+	// no legacy peer reads packed cells
+	if _, err := table.SerializeLegacy(); !errors.Is(err, ErrFormatLimit) {
+		t.Error("packed table serialized in the legacy format")
+	}
+	// nor is a legacy header of a 32772 byte checksum read as packed
+	legacy := []byte{0, 200, 0, 8, 0x80, 4, 0, 3, 3}
+	legacy = append(legacy, table.packedCells()...)
+	if _, err := Deserialize(legacy); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("flagged legacy deserialize error want %v, get %v", ErrCorrupt, err)
+	}
+
+	if _, err := Deserialize(ser[:len(ser)-1]); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("truncated deserialize error want %v, get %v", ErrCorrupt, err)
+	}
+	if err := table.Subtract(NewTable(200, 8, 1, 3)); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("subtract error want %v, get %v", ErrParamMismatch, err)
+	}
+}
+
+func TestPackedTable_Decode(t *testing.T) {
+	r := testRand(t)
+
+	alice, _ := NewPackedTable(512, 8, 4, 3, 3)
+	bob, _ := NewPackedTable(512, 8, 4, 3, 3)
+	b := make([]byte, 8)
+	for i := 0; i < 2000; i++ {
+		r.Read(b)
+		alice.Insert(b)
+		bob.Insert(b)
+	}
+	for i := 0; i < 40; i++ {
+		r.Read(b)
+		alice.Insert(b)
+	}
+	for i := 0; i < 30; i++ {
+		r.Read(b)
+		bob.Insert(b)
+	}
+
+	// counts wrapped around long before the subtraction
+	ser, _ := bob.Serialize()
+	remote, err := Deserialize(ser)
+	if err != nil {
+		t.Fatalf("deserialize error: %v", err)
+	}
+	if err := alice.Subtract(remote); err != nil {
+		t.Fatalf("subtract error: %v", err)
+	}
+	diff, err := alice.Decode(WithVerify())
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if diff.AlphaLen() != 40 || diff.BetaLen() != 30 {
+		t.Errorf("decode diff number mismatched want 40/30, get %d/%d", diff.AlphaLen(), diff.BetaLen())
+	}
+}
+
+func TestNewPackedTable(t *testing.T) {
+	for _, c := range [][2]int{{0, 3}, {65, 3}, {4, 1}, {4, 17}} {
+		if _, err := NewPackedTable(64, 8, c[0], c[1], 3); err == nil {
+			t.Errorf("%d checksum bits and %d count bits accepted", c[0], c[1])
+		}
+	}
+	for _, c := range [][2]int{{0, 1}, {2, 3}, {8, 0}} {
+		if _, err := NewPackedTable(uint(c[0]), 8, 4, 3, c[1]); err == nil {
+			t.Errorf("%d hash functions over %d buckets accepted", c[1], c[0])
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package iblt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A PersistentTable keeps its buckets in a memory mapped file, so a table
+// over a large set survives restarts without rehashing the set.
+//
+// The file starts with a page holding two header slots, the valid one with
+// the higher generation is current. Two arenas of bucket cells follow. The
+// stable arena holds the table as of the last checkpoint and is never
+// written outside of Checkpoint, the working arena holds the live table.
+// Every Insert, Delete and Subtract is appended to a journal next to the
+// file before it is applied to the working arena.
+//
+// Opening a table copies the stable arena over the working one and replays
+// the journal, so a crash at any point, even halfway through writing a
+// bucket or a header, loses at most the operations since the last Sync.
+// A PersistentTable is not safe for concurrent use.
+type PersistentTable struct {
+	file     *os.File
+	journal  *os.File
+	mem      []byte
+	hdr      persistHeader
+	cellLen  int
+	arenaLen int
+	// sequence number of the last journaled operation
+	seq uint64
+}
+
+const (
+	persistMagic   = "IBLTMMAP"
+	persistVersion = 1
+	pageSize       = 4096
+	// a header takes 68 bytes, the last 4 being its checksum
+	headerSlot = 128
+	headerLen  = 64
+	// journal record: sequence number, operation, payload length, payload, checksum
+	recordHead = 8 + 1 + 4
+	recordTail = 4
+
+	journalSuffix = ".journal"
+)
+
+const (
+	opInsert   = 'I'
+	opDelete   = 'D'
+	opSubtract = 'S'
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type persistHeader struct {
+	// index of the stable arena, 0 or 1
+	stable     uint16
+	bktNum     uint
+	dataLen    int
+	hashLen    int
+	hashNum    int
+	key0       uint64
+	key1       uint64
+	generation uint64
+	// sequence number of the last operation in the stable arena
+	checkpoint uint64
+}
+
+func (h persistHeader) marshal(b []byte) {
+	copy(b, persistMagic)
+	binary.BigEndian.PutUint16(b[8:], persistVersion)
+	binary.BigEndian.PutUint16(b[10:], h.stable)
+	binary.BigEndian.PutUint32(b[12:], uint32(h.dataLen))
+	binary.BigEndian.PutUint64(b[16:], uint64(h.bktNum))
+	binary.BigEndian.PutUint32(b[24:], uint32(h.hashLen))
+	binary.BigEndian.PutUint32(b[28:], uint32(h.hashNum))
+	binary.BigEndian.PutUint64(b[32:], h.key0)
+	binary.BigEndian.PutUint64(b[40:], h.key1)
+	binary.BigEndian.PutUint64(b[48:], h.generation)
+	binary.BigEndian.PutUint64(b[56:], h.checkpoint)
+	binary.BigEndian.PutUint32(b[headerLen:], crc32.Checksum(b[:headerLen], crcTable))
+}
+
+func unmarshalHeader(b []byte) (persistHeader, bool) {
+	var h persistHeader
+	if string(b[:8]) != persistMagic || binary.BigEndian.Uint16(b[8:]) != persistVersion {
+		return h, false
+	}
+	if binary.BigEndian.Uint32(b[headerLen:]) != crc32.Checksum(b[:headerLen], crcTable) {
+		return h, false
+	}
+
+	h.stable = binary.BigEndian.Uint16(b[10:])
+	h.dataLen = int(binary.BigEndian.Uint32(b[12:]))
+	h.bktNum = uint(binary.BigEndian.Uint64(b[16:]))
+	h.hashLen = int(binary.BigEndian.Uint32(b[24:]))
+	h.hashNum = int(binary.BigEndian.Uint32(b[28:]))
+	h.key0 = binary.BigEndian.Uint64(b[32:])
+	h.key1 = binary.BigEndian.Uint64(b[40:])
+	h.generation = binary.BigEndian.Uint64(b[48:])
+	h.checkpoint = binary.BigEndian.Uint64(b[56:])
+	return h, h.stable <= 1
+}
+
+// a cell is a 64 bit count, the data sum and the hash sum, padded to 8 bytes
+func layout(h persistHeader) (cellLen int, arenaLen int) {
+	cellLen = (8 + h.dataLen + h.hashLen + 7) / 8 * 8
+	arenaLen = (int(h.bktNum)*cellLen + pageSize - 1) / pageSize * pageSize
+	return cellLen, arenaLen
+}
+
+// CreatePersistentTable creates a table file at path and its journal at
+// path + ".journal", parameters as in NewTable. It fails if path exists.
+func CreatePersistentTable(path string, buckets uint, dataLen int, hashLen int, hashNum int) (*PersistentTable, error) {
+	if hashLen < 1 || hashLen > maxHashBits/8 || checkShape(buckets, hashNum) != nil {
+		return nil, fmt.Errorf("%d buckets, %d byte checksum and %d hash functions make no table",
+			buckets, hashLen, hashNum)
+	}
+	hdr := persistHeader{
+		bktNum:     buckets,
+		dataLen:    dataLen,
+		hashLen:    hashLen,
+		hashNum:    hashNum,
+		key0:       key0,
+		key1:       key1,
+		generation: 1,
+	}
+	_, arenaLen := layout(hdr)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(pageSize + 2*arenaLen)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	mem, err := mmap(f, pageSize+2*arenaLen)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	hdr.marshal(mem[hdr.generation%2*headerSlot:])
+	if err := msync(mem); err != nil {
+		munmap(mem)
+		f.Close()
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(path+journalSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		munmap(mem)
+		f.Close()
+		return nil, err
+	}
+
+	return newPersistentTable(f, journal, mem, hdr), nil
+}
+
+// OpenPersistentTable opens a table created by CreatePersistentTable and
+// replays its journal
+func OpenPersistentTable(path string) (*PersistentTable, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() < pageSize {
+		f.Close()
+		return nil, ErrCorrupt
+	}
+	mem, err := mmap(f, int(info.Size()))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fail := func(err error) (*PersistentTable, error) {
+		munmap(mem)
+		f.Close()
+		return nil, err
+	}
+
+	h0, ok0 := unmarshalHeader(mem)
+	h1, ok1 := unmarshalHeader(mem[headerSlot:])
+	var hdr persistHeader
+	switch {
+	case ok0 && (!ok1 || h0.generation > h1.generation):
+		hdr = h0
+	case ok1:
+		hdr = h1
+	default:
+		return fail(ErrCorrupt)
+	}
+	if hdr.key0 != key0 || hdr.key1 != key1 {
+		return fail(&ParamMismatchError{"hash key", int(key0), int(hdr.key0)})
+	}
+	if hdr.hashLen < 1 || hdr.hashLen > maxHashBits/8 || checkShape(hdr.bktNum, hdr.hashNum) != nil {
+		return fail(ErrCorrupt)
+	}
+	if _, arenaLen := layout(hdr); int64(pageSize+2*arenaLen) != info.Size() {
+		return fail(ErrCorrupt)
+	}
+
+	journal, err := os.OpenFile(path+journalSuffix, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fail(err)
+	}
+	p := newPersistentTable(f, journal, mem, hdr)
+	// the working arena may hold anything from before the crash
+	copy(p.working(), p.arena(hdr.stable))
+	if err := p.replay(); err != nil {
+		journal.Close()
+		return fail(err)
+	}
+
+	return p, nil
+}
+
+func newPersistentTable(f *os.File, journal *os.File, mem []byte, hdr persistHeader) *PersistentTable {
+	cellLen, arenaLen := layout(hdr)
+	return &PersistentTable{
+		file:     f,
+		journal:  journal,
+		mem:      mem,
+		hdr:      hdr,
+		cellLen:  cellLen,
+		arenaLen: arenaLen,
+		seq:      hdr.checkpoint,
+	}
+}
+
+// replay applies the journaled operations past the checkpoint to the working
+// arena and cuts off a torn record at the end of the journal
+func (p *PersistentTable) replay() error {
+	if _, err := p.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(p.journal)
+	if err != nil {
+		return err
+	}
+
+	off := 0
+	for len(b)-off >= recordHead+recordTail {
+		seq := binary.BigEndian.Uint64(b[off:])
+		op := b[off+8]
+		size := int(binary.BigEndian.Uint32(b[off+9:]))
+		end := off + recordHead + size + recordTail
+		if size > len(b) || end > len(b) {
+			break
+		}
+		if binary.BigEndian.Uint32(b[end-recordTail:]) != crc32.Checksum(b[off:end-recordTail], crcTable) {
+			break
+		}
+		if seq > p.hdr.checkpoint {
+			if err := p.apply(op, b[off+recordHead:end-recordTail]); err != nil {
+				return ErrCorrupt
+			}
+			p.seq = seq
+		}
+		off = end
+	}
+
+	if off < len(b) {
+		return p.journal.Truncate(int64(off))
+	}
+	return nil
+}
+
+func (p *PersistentTable) arena(i uint16) []byte {
+	off := pageSize + int(i)*p.arenaLen
+	return p.mem[off : off+p.arenaLen]
+}
+
+func (p *PersistentTable) working() []byte {
+	return p.arena(1 - p.hdr.stable)
+}
+
+// cell returns the count, data sum and hash sum of bucket idx in arena
+func (p *PersistentTable) cell(arena []byte, idx uint) (count []byte, dataSum []byte, hashSum []byte) {
+	c := arena[int(idx)*p.cellLen:]
+	return c[:8], c[8 : 8+p.hdr.dataLen], c[8+p.hdr.dataLen : 8+p.hdr.dataLen+p.hdr.hashLen]
+}
+
+func addCount(b []byte, n int64) {
+	binary.BigEndian.PutUint64(b, uint64(int64(binary.BigEndian.Uint64(b))+n))
+}
+
+func (p *PersistentTable) apply(op byte, payload []byte) error {
+	arena := p.working()
+	switch op {
+	case opInsert, opDelete:
+		if len(payload) != p.hdr.dataLen {
+			return ErrDataLength
+		}
+		h := sipHash(payload)
+		n := int64(1)
+		if op == opDelete {
+			n = -1
+		}
+		for _, i := range indexes(payload, p.hdr.bktNum, p.hdr.hashNum) {
+			count, dataSum, hashSum := p.cell(arena, i)
+			xor(dataSum, payload)
+			xor(hashSum, h)
+			addCount(count, n)
+		}
+	case opSubtract:
+		if len(payload) != int(p.hdr.bktNum)*p.cellLen {
+			return ErrCorrupt
+		}
+		for i := uint(0); i < p.hdr.bktNum; i++ {
+			count, dataSum, hashSum := p.cell(arena, i)
+			aCount, aDataSum, aHashSum := p.cell(payload, i)
+			xor(dataSum, aDataSum)
+			xor(hashSum, aHashSum)
+			addCount(count, -int64(binary.BigEndian.Uint64(aCount)))
+		}
+	default:
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// record journals an operation, then applies it
+func (p *PersistentTable) record(op byte, payload []byte) error {
+	if op != opSubtract && len(payload) != p.hdr.dataLen {
+		return ErrDataLength
+	}
+
+	rec := make([]byte, recordHead+len(payload)+recordTail)
+	binary.BigEndian.PutUint64(rec, p.seq+1)
+	rec[8] = op
+	binary.BigEndian.PutUint32(rec[9:], uint32(len(payload)))
+	copy(rec[recordHead:], payload)
+	binary.BigEndian.PutUint32(rec[len(rec)-recordTail:], crc32.Checksum(rec[:len(rec)-recordTail], crcTable))
+	if _, err := p.journal.Write(rec); err != nil {
+		return err
+	}
+	p.seq++
+
+	return p.apply(op, payload)
+}
+
+func (p *PersistentTable) Insert(d []byte) error {
+	return p.record(opInsert, d)
+}
+
+func (p *PersistentTable) Delete(d []byte) error {
+	return p.record(opDelete, d)
+}
+
+// Modify callee, p = p - a
+func (p *PersistentTable) Subtract(a *Table) error {
+	if err := p.shape().check(a); err != nil {
+		return err
+	}
+
+	payload := make([]byte, int(p.hdr.bktNum)*p.cellLen)
+	for i, bkt := range a.buckets {
+		if bkt == nil {
+			continue
+		}
+		count, dataSum, hashSum := p.cell(payload, uint(i))
+		binary.BigEndian.PutUint64(count, uint64(bkt.count))
+		copy(dataSum, bkt.dataSum)
+		copy(hashSum, bkt.hashSum)
+	}
+	return p.record(opSubtract, payload)
+}
+
+// shape is an empty table with the parameters of p
+func (p *PersistentTable) shape() *Table {
+	return &Table{
+		bktNum:   p.hdr.bktNum,
+		dataLen:  p.hdr.dataLen,
+		hashLen:  p.hdr.hashLen,
+		hashNum:  p.hdr.hashNum,
+		buckets:  make([]*Bucket, p.hdr.bktNum),
+		hashBits: p.hdr.hashLen * 8,
+	}
+}
+
+// Table loads the live table into memory
+func (p *PersistentTable) Table() *Table {
+	t := NewTable(p.hdr.bktNum, p.hdr.dataLen, p.hdr.hashLen, p.hdr.hashNum)
+	arena := p.working()
+	for i := range t.buckets {
+		count, dataSum, hashSum := p.cell(arena, uint(i))
+		bkt := NewBucket(p.hdr.dataLen, p.hdr.hashLen)
+		bkt.count = int(int64(binary.BigEndian.Uint64(count)))
+		copy(bkt.dataSum, dataSum)
+		copy(bkt.hashSum, hashSum)
+		if !bkt.empty() {
+			t.buckets[i] = bkt
+		}
+	}
+	return t
+}
+
+// Decode decodes an in-memory copy of the table. Unlike Table.Decode it
+// leaves the persistent table untouched.
+func (p *PersistentTable) Decode(opts ...DecodeOption) (*Diff, error) {
+	return p.Table().Decode(opts...)
+}
+
+// Sync makes the journaled operations durable
+func (p *PersistentTable) Sync() error {
+	return p.journal.Sync()
+}
+
+// Checkpoint writes the working arena back and promotes it to the stable
+// arena, then empties the journal. Reopening after a checkpoint replays
+// nothing.
+func (p *PersistentTable) Checkpoint() error {
+	if err := msync(p.mem); err != nil {
+		return err
+	}
+
+	hdr := p.hdr
+	hdr.stable = 1 - hdr.stable
+	hdr.generation++
+	hdr.checkpoint = p.seq
+	// the other slot keeps the previous header in case this write tears
+	hdr.marshal(p.mem[hdr.generation%2*headerSlot:])
+	if err := msync(p.mem[:pageSize]); err != nil {
+		return err
+	}
+	p.hdr = hdr
+
+	if err := p.journal.Truncate(0); err != nil {
+		return err
+	}
+	if err := p.journal.Sync(); err != nil {
+		return err
+	}
+	copy(p.working(), p.arena(p.hdr.stable))
+	return nil
+}
+
+// Close checkpoints the table and releases the file
+func (p *PersistentTable) Close() error {
+	err := p.Checkpoint()
+	if e := munmap(p.mem); err == nil {
+		err = e
+	}
+	if e := p.journal.Close(); err == nil {
+		err = e
+	}
+	if e := p.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+//go:build linux || darwin
+
+package iblt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crash drops the table without checkpointing, as a killed process would
+func crash(p *PersistentTable) {
+	munmap(p.mem)
+	p.journal.Close()
+	p.file.Close()
+}
+
+func TestPersistentTable_Reopen(t *testing.T) {
+	r := testRand(t)
+
+	path := filepath.Join(t.TempDir(), "table")
+	p, err := CreatePersistentTable(path, 512, 8, 1, 4)
+	if err != nil {
+		t.Fatalf("create error: %v", err)
+	}
+	mem := NewTable(512, 8, 1, 4)
+	both := func(op func(s Set, b []byte) error, n int) {
+		b := make([]byte, 8)
+		for i := 0; i < n; i++ {
+			r.Read(b)
+			if err := op(p, b); err != nil {
+				t.Fatalf("persistent table error: %v", err)
+			}
+			if err := op(mem, b); err != nil {
+				t.Fatalf("table error: %v", err)
+			}
+		}
+	}
+	insert := func(s Set, b []byte) error { return s.Insert(b) }
+	remove := func(s Set, b []byte) error { return s.Delete(b) }
+	reopen := func() {
+		p, err = OpenPersistentTable(path)
+		if err != nil {
+			t.Fatalf("open error: %v", err)
+		}
+		if !p.Table().equal(mem) {
+			t.Fatal("reopened table mismatches")
+		}
+	}
+
+	both(insert, 200)
+	if err := p.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+	reopen()
+
+	// operations after a checkpoint only live in the journal
+	both(remove, 50)
+	if err := p.Checkpoint(); err != nil {
+		t.Fatalf("checkpoint error: %v", err)
+	}
+	both(insert, 100)
+	both(remove, 20)
+	if err := p.Sync(); err != nil {
+		t.Fatalf("sync error: %v", err)
+	}
+	working := int64(pageSize + int(1-p.hdr.stable)*p.arenaLen)
+	crash(p)
+
+	// garble the working arena as a half written page would, and tear the
+	// last journal record
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := make([]byte, 1000)
+	r.Read(garbage)
+	if _, err := f.WriteAt(garbage, working); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	journal, err := os.OpenFile(path+journalSuffix, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := journal.Write([]byte{0, 0, 0, 0, 0, 0, 1, 0, opInsert, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+	reopen()
+
+	// the torn record is gone, later records replay after it
+	both(insert, 10)
+	crash(p)
+	reopen()
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+	if _, err := CreatePersistentTable(path, 512, 8, 1, 4); err == nil {
+		t.Error("create overwrote an existing table")
+	}
+}
+
+func TestPersistentTable_Subtract(t *testing.T) {
+	r := testRand(t)
+
+	path := filepath.Join(t.TempDir(), "table")
+	p, err := CreatePersistentTable(path, 256, 8, 1, 4)
+	if err != nil {
+		t.Fatalf("create error: %v", err)
+	}
+	remote := NewTable(256, 8, 1, 4)
+	b := make([]byte, 8)
+	for i := 0; i < 500; i++ {
+		r.Read(b)
+		p.Insert(b)
+		remote.Insert(b)
+	}
+	for i := 0; i < 30; i++ {
+		r.Read(b)
+		p.Insert(b)
+	}
+	for i := 0; i < 40; i++ {
+		r.Read(b)
+		remote.Insert(b)
+	}
+
+	if err := p.Subtract(NewTable(256, 8, 2, 4)); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("subtract error want %v, get %v", ErrParamMismatch, err)
+	}
+	if err := p.Subtract(remote); err != nil {
+		t.Fatalf("subtract error: %v", err)
+	}
+	crash(p)
+
+	for i := 0; i < 2; i++ {
+		// decoding leaves the persistent table intact, decode it twice
+		p, err = OpenPersistentTable(path)
+		if err != nil {
+			t.Fatalf("open error: %v", err)
+		}
+		diff, err := p.Decode()
+		if err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		if diff.AlphaLen() != 30 || diff.BetaLen() != 40 {
+			t.Errorf("decode diff number mismatched want 30/40, get %d/%d", diff.AlphaLen(), diff.BetaLen())
+		}
+		if err := p.Close(); err != nil {
+			t.Fatalf("close error: %v", err)
+		}
+	}
+}
+
+func TestPersistentTable_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	if _, err := CreatePersistentTable(path, 2, 8, 1, 4); err == nil {
+		t.Fatal("4 hash functions over 2 buckets accepted")
+	}
+	p, err := CreatePersistentTable(path, 64, 8, 1, 4)
+	if err != nil {
+		t.Fatalf("create error: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+
+	// the previous header takes over when the current one is torn
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("garbage"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = OpenPersistentTable(path); err != nil {
+		t.Fatalf("open with one torn header error: %v", err)
+	}
+	crash(p)
+
+	if _, err := f.WriteAt([]byte("garbage"), headerSlot); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := OpenPersistentTable(path); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("open with torn headers error want %v, get %v", ErrCorrupt, err)
+	}
+}
@@ -0,0 +1,226 @@
+package iblt
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+type item [8]byte
+
+func quickConfig(t *testing.T) *quick.Config {
+	return &quick.Config{MaxCount: 200, Rand: testRand(t)}
+}
+
+// set removes repeated items, keeping the first
+func set(items []item) []item {
+	seen := make(map[item]bool, len(items))
+	var rtn []item
+	for _, it := range items {
+		if !seen[it] {
+			seen[it] = true
+			rtn = append(rtn, it)
+		}
+	}
+	return rtn
+}
+
+// a table sized to decode n items with room to spare
+func propertyTable(n int) *Table {
+	return NewTable(uint(2*n+16), 8, 2, 3)
+}
+
+func insertAll(t *Table, items []item) {
+	for _, it := range items {
+		t.Insert(it[:])
+	}
+}
+
+func sortedItems(b [][]byte) [][]byte {
+	sort.Slice(b, func(i, j int) bool {
+		return bytes.Compare(b[i], b[j]) < 0
+	})
+	return b
+}
+
+func itemSlices(items []item) [][]byte {
+	rtn := make([][]byte, len(items))
+	for i := range items {
+		rtn[i] = items[i][:]
+	}
+	return rtn
+}
+
+func equalItems(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = sortedItems(a), sortedItems(b)
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPropertyInsertDelete(t *testing.T) {
+	f := func(items []item) bool {
+		table := propertyTable(len(items))
+		insertAll(table, items)
+		for _, it := range items {
+			table.Delete(it[:])
+		}
+		return table.empty()
+	}
+	if err := quick.Check(f, quickConfig(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPropertySubtract(t *testing.T) {
+	f := func(alpha, beta, shared []item) bool {
+		// the three sets must be disjoint
+		all := set(append(append(append([]item{}, shared...), alpha...), beta...))
+		nShared := min(len(shared), len(all))
+		nAlpha := min(len(alpha), len(all)-nShared)
+		shared, alpha, beta = all[:nShared], all[nShared:nShared+nAlpha], all[nShared+nAlpha:]
+
+		a := propertyTable(len(alpha) + len(beta))
+		b := propertyTable(len(alpha) + len(beta))
+		insertAll(a, append(append([]item{}, shared...), alpha...))
+		insertAll(b, append(append([]item{}, shared...), beta...))
+		if err := a.Subtract(b); err != nil {
+			return false
+		}
+		diff, err := a.Decode()
+		if err != nil {
+			// a sparse table rarely fails to decode, log it to tell it from
+			// a wrong difference
+			t.Logf("decode error: %v", err)
+			return true
+		}
+		return equalItems(diff.AlphaSlice(), itemSlices(alpha)) && equalItems(diff.BetaSlice(), itemSlices(beta))
+	}
+	if err := quick.Check(f, quickConfig(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPropertyAntiCommutative(t *testing.T) {
+	f := func(alpha, beta []item) bool {
+		a := propertyTable(len(alpha) + len(beta))
+		b := propertyTable(len(alpha) + len(beta))
+		insertAll(a, alpha)
+		insertAll(b, beta)
+
+		// (a - b) + (b - a) is empty
+		ab := a.Copy()
+		ab.Subtract(b)
+		ba := b.Copy()
+		ba.Subtract(a)
+		if err := ab.Add(ba); err != nil {
+			return false
+		}
+		return ab.empty()
+	}
+	if err := quick.Check(f, quickConfig(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPropertyInsertionOrder(t *testing.T) {
+	f := func(items []item, seed int64) bool {
+		a := propertyTable(len(items))
+		insertAll(a, items)
+		shuffled := append([]item{}, items...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		b := propertyTable(len(items))
+		insertAll(b, shuffled)
+		return a.equal(b)
+	}
+	if err := quick.Check(f, quickConfig(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPropertySerialize(t *testing.T) {
+	f := func(inserted, deleted []item, packed bool) bool {
+		table := propertyTable(len(inserted) + len(deleted))
+		if packed {
+			table, _ = NewPackedTable(uint(2*(len(inserted)+len(deleted))+16), 8, 5, 3, 3)
+		}
+		insertAll(table, inserted)
+		for _, it := range deleted {
+			table.Delete(it[:])
+		}
+		b, err := table.Serialize()
+		if err != nil {
+			return false
+		}
+		got, err := Deserialize(b)
+		return err == nil && table.equal(got)
+	}
+	if err := quick.Check(f, quickConfig(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+// FuzzTable_Operations reads the input as operations of three bytes, an
+// opcode and a two byte item, and checks decoding against a multiset model
+func FuzzTable_Operations(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 0, 3, 4, 1, 5, 6})
+	f.Add([]byte{0, 1, 2, 1, 1, 2, 0, 1, 2})
+	f.Add([]byte{0, 0, 0, 1, 0, 1, 2, 0, 0})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		table := NewTable(32, 2, 2, 3)
+		model := make(map[[2]byte]int)
+		for i := 0; i+3 <= len(ops); i += 3 {
+			it := [2]byte{ops[i+1], ops[i+2]}
+			switch ops[i] % 3 {
+			case 0:
+				table.Insert(it[:])
+				model[it]++
+			case 1:
+				table.Delete(it[:])
+				model[it]--
+			case 2:
+				// subtract a table of the item, as Delete does
+				other := NewTable(32, 2, 2, 3)
+				other.Insert(it[:])
+				if err := table.Subtract(other); err != nil {
+					t.Fatalf("subtract error: %v", err)
+				}
+				model[it]--
+			}
+		}
+
+		var alpha, beta [][]byte
+		for it, n := range model {
+			it := it
+			switch {
+			case n == 1:
+				alpha = append(alpha, it[:])
+			case n == -1:
+				beta = append(beta, it[:])
+			case n != 0:
+				// a multiset difference is out of reach, only check that
+				// decoding terminates
+				table.Decode(WithMaxIterations(1 << 16))
+				return
+			}
+		}
+
+		diff, err := table.Decode(WithVerify())
+		if err != nil {
+			return
+		}
+		if !equalItems(diff.AlphaSlice(), alpha) || !equalItems(diff.BetaSlice(), beta) {
+			t.Errorf("decoded %x / %x, want %x / %x", diff.AlphaSlice(), diff.BetaSlice(), alpha, beta)
+		}
+	})
+}
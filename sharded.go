@@ -0,0 +1,114 @@
+package iblt
+
+import (
+	"fmt"
+
+	"github.com/dchest/siphash"
+)
+
+// ShardedTable routes items by a prefix of their hash into independent
+// tables. Every shard is serialized, subtracted and decoded on its own, so
+// when a difference concentrates in one key range only the shards that
+// failed to decode have to be resent, possibly rebuilt with more buckets.
+type ShardedTable struct {
+	shards []*Table
+}
+
+// Specify number of shards, then the parameters of every shard as in NewTable
+func NewShardedTable(shards int, buckets uint, dataLen int, hashLen int, hashNum int) (*ShardedTable, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("%d shards, want at least 1", shards)
+	}
+	s := &ShardedTable{
+		shards: make([]*Table, shards),
+	}
+	for i := range s.shards {
+		s.shards[i] = NewTable(buckets, dataLen, hashLen, hashNum)
+	}
+	return s, nil
+}
+
+// Shards is the number of shards
+func (s ShardedTable) Shards() int {
+	return len(s.shards)
+}
+
+// ShardOf tells which shard an item is routed to. It does not depend on
+// the parameters of the shards, so a shard can be rebuilt from the items
+// routed to it with a different number of buckets.
+func (s ShardedTable) ShardOf(d []byte) int {
+	// keys swapped from the checksum hash, shards must not correlate with it
+	h := siphash.Hash(key1, key0, d)
+	// top 32 bits scaled to the number of shards
+	return int((h >> 32) * uint64(len(s.shards)) >> 32)
+}
+
+func (s *ShardedTable) Insert(d []byte) error {
+	return s.shards[s.ShardOf(d)].Insert(d)
+}
+
+func (s *ShardedTable) Delete(d []byte) error {
+	return s.shards[s.ShardOf(d)].Delete(d)
+}
+
+// Shard returns shard i, for example to serialize it
+func (s ShardedTable) Shard(i int) *Table {
+	return s.shards[i]
+}
+
+// SetShard replaces shard i, for example with one rebuilt with more buckets
+func (s *ShardedTable) SetShard(i int, t *Table) {
+	s.shards[i] = t
+}
+
+// SubtractShard modifies shard i, shard = shard - a
+func (s *ShardedTable) SubtractShard(i int, a *Table) error {
+	return s.shards[i].Subtract(a)
+}
+
+// Modify callee shard by shard, s = s - a
+func (s *ShardedTable) Subtract(a *ShardedTable) error {
+	if len(s.shards) != len(a.shards) {
+		return &ParamMismatchError{"number of shards", len(s.shards), len(a.shards)}
+	}
+	for i := range s.shards {
+		if err := s.SubtractShard(i, a.shards[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeShard decodes shard i, it is self-destructive
+func (s *ShardedTable) DecodeShard(i int, opts ...DecodeOption) (*Diff, error) {
+	return s.shards[i].Decode(opts...)
+}
+
+// Decode decodes every shard and merges their diffs. If some shards fail,
+// the diff still holds the items of the others and the error is a
+// *ShardError naming the failed shards. Decode is self-destructive.
+func (s *ShardedTable) Decode(opts ...DecodeOption) (*Diff, error) {
+	var occupied uint
+	for _, t := range s.shards {
+		occupied += uint(t.residual())
+	}
+	diff := NewDiff(occupied)
+
+	var shardErr *ShardError
+	for i := range s.shards {
+		d, err := s.DecodeShard(i, opts...)
+		if err != nil {
+			if shardErr == nil {
+				shardErr = &ShardError{Errs: make(map[int]error)}
+			}
+			shardErr.Errs[i] = err
+			continue
+		}
+		diff.Merge(d)
+	}
+
+	if shardErr != nil {
+		return diff, shardErr
+	}
+	return diff, nil
+}
@@ -0,0 +1,131 @@
+package iblt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestShardedTable_ShardOf(t *testing.T) {
+	r := testRand(t)
+
+	s, err := NewShardedTable(16, 32, 8, 1, 4)
+	if err != nil {
+		t.Fatalf("new sharded table error: %v", err)
+	}
+	counts := make([]int, s.Shards())
+	b := make([]byte, 8)
+	for i := 0; i < 16000; i++ {
+		r.Read(b)
+		counts[s.ShardOf(b)]++
+	}
+	for i, c := range counts {
+		if c < 800 || c > 1200 {
+			t.Errorf("shard %d got %d of 16000 items", i, c)
+		}
+	}
+
+	for _, shards := range []int{0, -1} {
+		if _, err := NewShardedTable(shards, 32, 8, 1, 4); err == nil {
+			t.Errorf("%d shards accepted", shards)
+		}
+	}
+}
+
+func TestShardedTable_Decode(t *testing.T) {
+	r := testRand(t)
+
+	const (
+		shards  = 8
+		buckets = 64
+		hot     = 3
+	)
+	alice, _ := NewShardedTable(shards, buckets, 8, 1, 4)
+	bob, _ := NewShardedTable(shards, buckets, 8, 1, 4)
+
+	var aliceItems, bobItems [][]byte
+	insert := func(s *ShardedTable, items *[][]byte, b []byte) {
+		if err := s.Insert(b); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		*items = append(*items, b)
+	}
+	for i := 0; i < 2000; i++ {
+		b := make([]byte, 8)
+		r.Read(b)
+		insert(alice, &aliceItems, b)
+		insert(bob, &bobItems, b)
+	}
+	// a few differences spread over every shard
+	var alphaWant, betaWant [][]byte
+	for i := 0; i < 24; i++ {
+		b := make([]byte, 8)
+		r.Read(b)
+		insert(alice, &aliceItems, b)
+		alphaWant = append(alphaWant, b)
+	}
+	// and far more than a shard can hold in a single key range
+	for len(betaWant) < 200 {
+		b := make([]byte, 8)
+		r.Read(b)
+		if bob.ShardOf(b) == hot {
+			insert(bob, &bobItems, b)
+			betaWant = append(betaWant, b)
+		}
+	}
+
+	if err := alice.Subtract(bob); err != nil {
+		t.Fatalf("subtract error: %v", err)
+	}
+	diff, err := alice.Decode()
+	var shardErr *ShardError
+	if !errors.As(err, &shardErr) {
+		t.Fatalf("decode error is not a *ShardError: %v", err)
+	}
+	if !reflect.DeepEqual(shardErr.Failed(), []int{hot}) {
+		t.Fatalf("failed shards want [%d], get %v", hot, shardErr.Failed())
+	}
+	if !errors.Is(err, ErrNoPureBucket) && !errors.Is(err, ErrDirtyEntries) {
+		t.Errorf("shard error does not wrap a decode error: %v", err)
+	}
+
+	// retry the hot shard alone with more buckets
+	rebuild := func(items [][]byte) *Table {
+		table := NewTable(buckets*8, 8, 1, 4)
+		for _, b := range items {
+			if alice.ShardOf(b) == hot {
+				if err := table.Insert(b); err != nil {
+					t.Fatalf("insert error: %v", err)
+				}
+			}
+		}
+		return table
+	}
+	alice.SetShard(hot, rebuild(aliceItems))
+	if err := alice.SubtractShard(hot, rebuild(bobItems)); err != nil {
+		t.Fatalf("subtract shard error: %v", err)
+	}
+	retry, err := alice.DecodeShard(hot)
+	if err != nil {
+		t.Fatalf("decode shard error: %v", err)
+	}
+	diff.Merge(retry)
+
+	want := newByteSet(0)
+	for _, b := range alphaWant {
+		want.insert(b)
+	}
+	want.sort()
+	diff.Sort()
+	if !reflect.DeepEqual(diff.AlphaSlice(), want.slice()) {
+		t.Errorf("alpha mismatch want %d items, get %d", want.len(), diff.AlphaLen())
+	}
+	want = newByteSet(0)
+	for _, b := range betaWant {
+		want.insert(b)
+	}
+	want.sort()
+	if !reflect.DeepEqual(diff.BetaSlice(), want.slice()) {
+		t.Errorf("beta mismatch want %d items, get %d", want.len(), diff.BetaLen())
+	}
+}
@@ -0,0 +1,159 @@
+package iblt
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dchest/siphash"
+)
+
+// MaxShortIDLen is the longest short ID ShortID derives
+const MaxShortIDLen = 16
+
+// ShortID derives the salted n byte short ID of an item, n from 1 to
+// MaxShortIDLen. Peers must agree on salt and n.
+func ShortID(item []byte, salt uint64, n int) ([]byte, error) {
+	if n < 1 || n > MaxShortIDLen {
+		return nil, fmt.Errorf("short ID length %d out of range 1 to %d bytes", n, MaxShortIDLen)
+	}
+	return shortID(item, salt, n), nil
+}
+
+func shortID(item []byte, salt uint64, n int) []byte {
+	rtn := make([]byte, MaxShortIDLen)
+	h0, h1 := siphash.Hash128(salt, ^salt, item)
+	binary.BigEndian.PutUint64(rtn, h0)
+	binary.BigEndian.PutUint64(rtn[8:], h1)
+	return rtn[:n]
+}
+
+// ShortIDTable stores the short IDs of long items, such as 32 byte hashes,
+// so that cells cost the short ID length instead of the item length. A
+// reverse index resolves decoded short IDs back to local items.
+//
+// Two items of the same short ID cannot be told apart. A collision between
+// local items fails Insert, one between a local item and a remote one fails
+// Check once the remote item arrives. Different items of the same short ID
+// on both sides cancel out in the table and go unnoticed, which happens with
+// probability about local*remote/2^(8*idLen).
+type ShortIDTable struct {
+	table *Table
+	salt  uint64
+	idLen int
+	// local items by short ID
+	items map[string][]byte
+}
+
+// Specify the salt and short ID length (in byte) shared with peers, then
+// table parameters as in NewTable with the short ID length as data length
+func NewShortIDTable(salt uint64, buckets uint, idLen int, hashLen int, hashNum int) (*ShortIDTable, error) {
+	if idLen < 1 || idLen > MaxShortIDLen {
+		return nil, fmt.Errorf("short ID length %d out of range 1 to %d bytes", idLen, MaxShortIDLen)
+	}
+	return &ShortIDTable{
+		table: NewTable(buckets, idLen, hashLen, hashNum),
+		salt:  salt,
+		idLen: idLen,
+		items: make(map[string][]byte),
+	}, nil
+}
+
+// ShortID derives the short ID of an item with the salt of the table
+func (s ShortIDTable) ShortID(item []byte) []byte {
+	return shortID(item, s.salt, s.idLen)
+}
+
+// Insert fails with ErrShortIDCollision if another item has the same short ID
+func (s *ShortIDTable) Insert(item []byte) error {
+	id := s.ShortID(item)
+	if other, ok := s.items[string(id)]; ok {
+		if string(other) == string(item) {
+			return fmt.Errorf("%w: item %x", ErrDuplicate, item)
+		}
+		return fmt.Errorf("%w: %x and %x", ErrShortIDCollision, other, item)
+	}
+	if err := s.table.Insert(id); err != nil {
+		return err
+	}
+	s.items[string(id)] = append([]byte{}, item...)
+	return nil
+}
+
+func (s *ShortIDTable) Delete(item []byte) error {
+	id := s.ShortID(item)
+	other, ok := s.items[string(id)]
+	if !ok || string(other) != string(item) {
+		return fmt.Errorf("%w: item %x", ErrNotFound, item)
+	}
+	if err := s.table.Delete(id); err != nil {
+		return err
+	}
+	delete(s.items, string(id))
+	return nil
+}
+
+// Table is the table of short IDs to send to peers, it must not be modified
+func (s ShortIDTable) Table() *Table {
+	return s.table
+}
+
+// ShortDiff is the difference between a ShortIDTable and a remote table
+type ShortDiff struct {
+	// local items missing from the remote
+	Local [][]byte
+	// short IDs of remote items missing locally, for the remote to Resolve
+	Remote [][]byte
+}
+
+// Reconcile decodes the difference to the table of a remote ShortIDTable.
+// The local table is left untouched.
+func (s ShortIDTable) Reconcile(remote *Table, opts ...DecodeOption) (*ShortDiff, error) {
+	// a snapshot would mark the live table shared, copying its buckets on
+	// every later Insert
+	t := s.table.Copy()
+	// the copy is scratch, keep its changes from the observer of the table
+	t.SetObserver(nil)
+	if err := t.Subtract(remote); err != nil {
+		return nil, err
+	}
+	diff, err := t.Decode(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	rtn := &ShortDiff{Remote: diff.BetaSlice()}
+	for _, id := range diff.AlphaSlice() {
+		item, ok := s.items[string(id)]
+		if !ok {
+			// only a bogus peel yields a local short ID that was never inserted
+			return nil, fmt.Errorf("%w: short ID %x resolves to no local item", ErrVerification, id)
+		}
+		rtn.Local = append(rtn.Local, item)
+	}
+	return rtn, nil
+}
+
+// Resolve looks the items of short IDs up, answering the Remote side of a
+// peer's ShortDiff
+func (s ShortIDTable) Resolve(ids [][]byte) ([][]byte, error) {
+	rtn := make([][]byte, len(ids))
+	for i, id := range ids {
+		item, ok := s.items[string(id)]
+		if !ok {
+			return nil, fmt.Errorf("%w: short ID %x", ErrNotFound, id)
+		}
+		rtn[i] = item
+	}
+	return rtn, nil
+}
+
+// Check fails with ErrShortIDCollision if a remote item has the short ID of
+// a different local item
+func (s ShortIDTable) Check(items [][]byte) error {
+	for _, item := range items {
+		if other, ok := s.items[string(s.ShortID(item))]; ok && string(other) != string(item) {
+			return fmt.Errorf("%w: local %x and remote %x", ErrShortIDCollision, other, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package iblt
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func randomItems(r *rand.Rand, n int, size int) [][]byte {
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = make([]byte, size)
+		r.Read(items[i])
+	}
+	return items
+}
+
+func sortItems(items [][]byte) [][]byte {
+	sort.Slice(items, func(i, j int) bool {
+		return string(items[i]) < string(items[j])
+	})
+	return items
+}
+
+func TestShortIDTable_Reconcile(t *testing.T) {
+	r := testRand(t)
+
+	salt := r.Uint64()
+	alice, _ := NewShortIDTable(salt, 128, 8, 1, 4)
+	bob, _ := NewShortIDTable(salt, 128, 8, 1, 4)
+
+	common := randomItems(r, 1000, 32)
+	aliceOnly := randomItems(r, 20, 32)
+	bobOnly := randomItems(r, 25, 32)
+	for _, item := range append(append([][]byte{}, common...), aliceOnly...) {
+		if err := alice.Insert(item); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+	}
+	for _, item := range append(append([][]byte{}, common...), bobOnly...) {
+		if err := bob.Insert(item); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+	}
+
+	// the table sent over holds short IDs only
+	b, err := bob.Table().Serialize()
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	remote, err := Deserialize(b)
+	if err != nil {
+		t.Fatalf("deserialize error: %v", err)
+	}
+	rec := &recorder{}
+	alice.Table().SetObserver(rec)
+	diff, err := alice.Reconcile(remote)
+	if err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	if rec.subtracts != 0 || len(rec.steps) != 0 {
+		t.Errorf("observed %d subtracts and %d peels of the scratch table", rec.subtracts, len(rec.steps))
+	}
+	if !reflect.DeepEqual(sortItems(diff.Local), sortItems(aliceOnly)) {
+		t.Errorf("local items mismatch, get %d items", len(diff.Local))
+	}
+
+	if err := alice.Insert(aliceOnly[0]); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("insert twice error want %v, get %v", ErrDuplicate, err)
+	}
+	if _, err := alice.Resolve(diff.Remote); !errors.Is(err, ErrNotFound) {
+		t.Errorf("resolve error want %v, get %v", ErrNotFound, err)
+	}
+	items, err := bob.Resolve(diff.Remote)
+	if err != nil {
+		t.Fatalf("resolve error: %v", err)
+	}
+	if !reflect.DeepEqual(sortItems(items), sortItems(bobOnly)) {
+		t.Errorf("remote items mismatch, get %d items", len(items))
+	}
+	if err := alice.Check(items); err != nil {
+		t.Errorf("check error: %v", err)
+	}
+
+	// reconciling again gives the same difference
+	if again, err := alice.Reconcile(remote); err != nil || len(again.Local) != len(aliceOnly) {
+		t.Errorf("second reconcile mismatch, error %v", err)
+	}
+	if alice.table.shared != nil {
+		t.Error("reconcile left the local table shared")
+	}
+}
+
+func TestShortID(t *testing.T) {
+	for _, n := range []int{0, MaxShortIDLen + 1} {
+		if _, err := ShortID([]byte("item"), 1, n); err == nil {
+			t.Errorf("%d byte short ID derived", n)
+		}
+		if _, err := NewShortIDTable(1, 64, n, 1, 3); err == nil {
+			t.Errorf("table of %d byte short IDs accepted", n)
+		}
+	}
+	id, err := ShortID([]byte("item"), 1, MaxShortIDLen)
+	if err != nil || len(id) != MaxShortIDLen {
+		t.Errorf("short ID %x, error %v", id, err)
+	}
+}
+
+func TestShortIDTable_Collision(t *testing.T) {
+	r := testRand(t)
+
+	// one byte short IDs collide soon
+	s, _ := NewShortIDTable(r.Uint64(), 16, 1, 1, 3)
+	byID := make(map[byte][]byte)
+	var local, remote []byte
+	for local == nil || remote == nil {
+		item := randomItems(r, 1, 32)[0]
+		id := s.ShortID(item)[0]
+		other, ok := byID[id]
+		if !ok {
+			byID[id] = item
+			continue
+		}
+		if local == nil {
+			if err := s.Insert(other); err != nil {
+				t.Fatalf("insert error: %v", err)
+			}
+			if err := s.Insert(item); !errors.Is(err, ErrShortIDCollision) {
+				t.Errorf("insert error want %v, get %v", ErrShortIDCollision, err)
+			}
+			local = other
+		} else if s.ShortID(local)[0] == id && string(item) != string(local) {
+			remote = item
+		}
+	}
+
+	if err := s.Check([][]byte{remote}); !errors.Is(err, ErrShortIDCollision) {
+		t.Errorf("check error want %v, get %v", ErrShortIDCollision, err)
+	}
+	if err := s.Delete(remote); !errors.Is(err, ErrNotFound) {
+		t.Error("deleted an item of a colliding short ID")
+	}
+	if err := s.Delete(local); err != nil {
+		t.Errorf("delete error: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+// Package simulate runs reproducible reconciliation trials, to measure how
+// often a table of given parameters decodes a difference of given size.
+//
+// Every trial draws its items from its own seed, the seed of the run plus
+// the trial number, so a failed trial is rerun alone with Trial:
+//
+//	res, err := simulate.Run(p, seed, 1000)
+//	fmt.Println(res.SuccessRate(), res.FailedSeeds)
+//	tr, err := simulate.Trial(p, res.FailedSeeds[0])
+package simulate
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/SheldonZhong/go-IBLT"
+)
+
+// Params describes the tables and sets of a trial, as the test cases of the
+// iblt package do
+type Params struct {
+	Buckets uint
+	DataLen int
+	HashLen int
+	HashNum int
+	// items only in the first set, only in the second and in both
+	Alpha  int
+	Beta   int
+	Shared int
+}
+
+func (p Params) check() error {
+	if p.Buckets == 0 || p.DataLen <= 0 || p.HashLen <= 0 || p.HashNum <= 0 {
+		return errors.New("buckets, data length, hash length and hash number must be positive")
+	}
+	if uint(p.HashNum) > p.Buckets {
+		return errors.New("hash number exceeds buckets")
+	}
+	if p.HashLen > 8 {
+		return errors.New("hash length exceeds 8 bytes")
+	}
+	if p.Alpha < 0 || p.Beta < 0 || p.Shared < 0 {
+		return errors.New("item numbers must not be negative")
+	}
+	// leave room to draw distinct items
+	if p.DataLen < 4 && p.Alpha+p.Beta+p.Shared > 1<<(8*uint(p.DataLen))/2 {
+		return errors.New("too many items for the data length")
+	}
+	return nil
+}
+
+// TrialResult is the outcome of a single trial
+type TrialResult struct {
+	Seed int64
+	// decoding error, nil if the table decoded
+	Err error
+	// decoded without error to a difference other than the one inserted
+	Wrong bool
+	// bogus items backed out while decoding
+	Collisions int
+	DecodeTime time.Duration
+	Stats      iblt.DecodeStats
+}
+
+// Decoded tells whether the trial decoded the exact difference
+func (r TrialResult) Decoded() bool {
+	return r.Err == nil && !r.Wrong
+}
+
+// Trial inserts the items drawn from seed into two tables, subtracts them
+// and decodes the difference
+func Trial(p Params, seed int64) (TrialResult, error) {
+	if err := p.check(); err != nil {
+		return TrialResult{}, err
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	seen := make(map[string]bool, p.Alpha+p.Beta+p.Shared)
+	draw := func() []byte {
+		b := make([]byte, p.DataLen)
+		for {
+			rng.Read(b)
+			if !seen[string(b)] {
+				seen[string(b)] = true
+				return b
+			}
+		}
+	}
+
+	alice := iblt.NewTable(p.Buckets, p.DataLen, p.HashLen, p.HashNum)
+	bob := iblt.NewTable(p.Buckets, p.DataLen, p.HashLen, p.HashNum)
+	alpha := make(map[string]bool, p.Alpha)
+	beta := make(map[string]bool, p.Beta)
+	for i := 0; i < p.Shared; i++ {
+		b := draw()
+		alice.Insert(b)
+		bob.Insert(b)
+	}
+	for i := 0; i < p.Alpha; i++ {
+		b := draw()
+		alice.Insert(b)
+		alpha[string(b)] = true
+	}
+	for i := 0; i < p.Beta; i++ {
+		b := draw()
+		bob.Insert(b)
+		beta[string(b)] = true
+	}
+	if err := alice.Subtract(bob); err != nil {
+		return TrialResult{}, err
+	}
+
+	res := TrialResult{Seed: seed}
+	start := time.Now()
+	diff, err := alice.Decode(iblt.WithStats(&res.Stats))
+	res.DecodeTime = time.Since(start)
+	res.Err = err
+	res.Collisions = res.Stats.Collisions
+	if err == nil {
+		res.Wrong = !same(diff.AlphaSlice(), alpha) || !same(diff.BetaSlice(), beta)
+	}
+	return res, nil
+}
+
+func same(items [][]byte, want map[string]bool) bool {
+	if len(items) != len(want) {
+		return false
+	}
+	for _, b := range items {
+		if !want[string(b)] {
+			return false
+		}
+	}
+	return true
+}
+
+// Result sums up the trials of a run
+type Result struct {
+	Params Params
+	Seed   int64
+	Trials int
+	// trials that decoded the exact difference
+	Decoded int
+	// trials that failed to decode
+	Failed int
+	// trials that decoded without error to a wrong difference
+	Wrong int
+	// trials that backed out bogus items, and the items backed out
+	CollisionTrials int
+	Collisions      int
+	DecodeTime      time.Duration
+	// seeds of the failed and wrong trials
+	FailedSeeds []int64
+}
+
+// Run runs trials with the seeds seed, seed+1 and so on
+func Run(p Params, seed int64, trials int) (Result, error) {
+	res := Result{Params: p, Seed: seed, Trials: trials}
+	for i := 0; i < trials; i++ {
+		tr, err := Trial(p, seed+int64(i))
+		if err != nil {
+			return res, err
+		}
+		switch {
+		case tr.Decoded():
+			res.Decoded++
+		case tr.Wrong:
+			res.Wrong++
+		default:
+			res.Failed++
+		}
+		if !tr.Decoded() {
+			res.FailedSeeds = append(res.FailedSeeds, tr.Seed)
+		}
+		if tr.Collisions > 0 {
+			res.CollisionTrials++
+			res.Collisions += tr.Collisions
+		}
+		res.DecodeTime += tr.DecodeTime
+	}
+	return res, nil
+}
+
+func (r Result) SuccessRate() float64 {
+	if r.Trials == 0 {
+		return 0
+	}
+	return float64(r.Decoded) / float64(r.Trials)
+}
+
+// CollisionRate is the share of trials that backed out bogus items
+func (r Result) CollisionRate() float64 {
+	if r.Trials == 0 {
+		return 0
+	}
+	return float64(r.CollisionTrials) / float64(r.Trials)
+}
+
+func (r Result) MeanDecodeTime() time.Duration {
+	if r.Trials == 0 {
+		return 0
+	}
+	return r.DecodeTime / time.Duration(r.Trials)
+}
@@ -0,0 +1,55 @@
+package simulate
+
+import (
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	p := Params{Buckets: 120, DataLen: 4, HashLen: 1, HashNum: 4, Alpha: 30, Beta: 30, Shared: 100}
+	res, err := Run(p, 1, 200)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if res.Decoded+res.Failed+res.Wrong != res.Trials {
+		t.Errorf("trials do not add up: %+v", res)
+	}
+	if res.SuccessRate() < 0.95 {
+		t.Errorf("success rate %.3f of a lightly loaded table", res.SuccessRate())
+	}
+
+	// the same seed gives the same trials
+	again, err := Run(p, 1, 200)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if again.Decoded != res.Decoded || again.Collisions != res.Collisions {
+		t.Errorf("runs of the same seed differ: %+v, %+v", res, again)
+	}
+	for _, seed := range res.FailedSeeds {
+		tr, err := Trial(p, seed)
+		if err != nil {
+			t.Fatalf("trial error: %v", err)
+		}
+		if tr.Decoded() {
+			t.Errorf("failed trial %d decoded on rerun", seed)
+		}
+	}
+
+	// an overloaded table fails
+	p.Buckets = 40
+	if res, _ := Run(p, 1, 20); res.Failed == 0 {
+		t.Errorf("overloaded table always decoded: %+v", res)
+	}
+}
+
+func TestParams(t *testing.T) {
+	for _, p := range []Params{
+		{Buckets: 0, DataLen: 4, HashLen: 1, HashNum: 4},
+		{Buckets: 3, DataLen: 4, HashLen: 1, HashNum: 4},
+		{Buckets: 64, DataLen: 1, HashLen: 1, HashNum: 4, Alpha: 200},
+	} {
+		if _, err := Trial(p, 1); err == nil {
+			t.Errorf("params %+v accepted", p)
+		}
+	}
+}
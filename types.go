@@ -1,12 +1,9 @@
 package iblt
 
 import (
-	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"github.com/dchest/siphash"
-	"github.com/seiflotfy/cuckoofilter"
 )
 
 const (
@@ -52,13 +49,40 @@ type Bucket struct {
 	dataSum []byte
 	hashSum []byte
 	count   int
+	// checksum bits kept in hashSum, the low bits of its last byte are zero
+	hashBits int
+	// count wraps around at countBits bits, unbounded if 0
+	countBits int
 }
 
 func NewBucket(dataLen, hashLen int) *Bucket {
+	return newBucket(dataLen, hashLen*8, 0)
+}
+
+func newBucket(dataLen, hashBits, countBits int) *Bucket {
 	return &Bucket{
-		dataSum: make([]byte, dataLen),
-		hashSum: make([]byte, hashLen),
-		count:   0,
+		dataSum:   make([]byte, dataLen),
+		hashSum:   make([]byte, (hashBits+7)/8),
+		count:     0,
+		hashBits:  hashBits,
+		countBits: countBits,
+	}
+}
+
+// hash is the checksum of d cut to hashBits
+func (b Bucket) hash(d []byte) []byte {
+	h := sipHash(d)
+	if r := b.hashBits % 8; r != 0 {
+		h[len(b.hashSum)-1] &= byte(0xff << (8 - r))
+	}
+	return h
+}
+
+// wrap sign extends count from countBits bits
+func (b *Bucket) wrap() {
+	if b.countBits > 0 {
+		shift := 64 - b.countBits
+		b.count = int(int64(b.count) << shift >> shift)
 	}
 }
 
@@ -70,30 +94,38 @@ func (b *Bucket) xor(a *Bucket) {
 func (b *Bucket) subtract(a *Bucket) {
 	b.xor(a)
 	b.count = b.count - a.count
+	b.wrap()
+}
+
+func (b *Bucket) add(a *Bucket) {
+	b.xor(a)
+	b.count = b.count + a.count
+	b.wrap()
 }
 
 func (b *Bucket) operate(d []byte, sign bool) {
 	xor(b.dataSum, d)
-	h := sipHash(d)
+	h := b.hash(d)
 	xor(b.hashSum, h)
 	if sign {
 		b.count++
 	} else {
 		b.count--
 	}
+	b.wrap()
 }
 
 func (b Bucket) copy() *Bucket {
-	bkt := NewBucket(len(b.dataSum), len(b.hashSum))
+	bkt := newBucket(len(b.dataSum), b.hashBits, b.countBits)
 	copy(bkt.dataSum, b.dataSum)
-	bkt.hashSum = b.hashSum
+	copy(bkt.hashSum, b.hashSum)
 	bkt.count = b.count
 	return bkt
 }
 
 func (b Bucket) pure() bool {
 	if b.count == 1 || b.count == -1 {
-		h := sipHash(b.dataSum)
+		h := b.hash(b.dataSum)
 		if equalPrefix(b.hashSum, h) {
 			return true
 		}
@@ -112,9 +144,11 @@ func (b Bucket) String() string {
 		b.dataSum, b.hashSum, b.count)
 }
 
+// set of byte slices, keyed by their content, in insertion order until a
+// delete moves the last element into its hole
 type byteSet struct {
-	set    [][]byte
-	filter *cuckoo.Filter
+	set   [][]byte
+	index map[string]int
 }
 
 func (s byteSet) slice() [][]byte {
@@ -123,8 +157,8 @@ func (s byteSet) slice() [][]byte {
 
 func newByteSet(cap uint) *byteSet {
 	return &byteSet{
-		set:    make([][]byte, 0),
-		filter: cuckoo.NewFilter(cap),
+		set:   make([][]byte, 0, cap),
+		index: make(map[string]int, cap),
 	}
 }
 
@@ -134,46 +168,47 @@ func (s byteSet) len() int {
 
 func (s *byteSet) insert(b []byte) {
 	if !s.test(b) {
-		s.filter.Insert(b)
+		s.index[string(b)] = len(s.set)
 		s.set = append(s.set, b)
 	}
 }
 
 func (s byteSet) test(b []byte) bool {
-	if s.filter.Lookup(b) {
-		// possibly in set, false positive
-		for _, ele := range s.set {
-			if bytes.Equal(b, ele) {
-				return true
-			}
-		}
-	}
-	return false
+	_, ok := s.index[string(b)]
+	return ok
 }
 
+// delete moves the last element into the hole, it does nothing if b is absent
 func (s *byteSet) delete(b []byte) {
-	s.filter.Delete(b)
-	idx := 0
-	for i, ele := range s.set {
-		if bytes.Equal(b, ele) {
-			idx = i
-			break
-		}
+	idx, ok := s.index[string(b)]
+	if !ok {
+		return
 	}
-	s.set = append(s.set[:idx], s.set[idx+1:]...)
+	last := len(s.set) - 1
+	if idx != last {
+		s.set[idx] = s.set[last]
+		s.index[string(s.set[idx])] = idx
+	}
+	s.set[last] = nil
+	s.set = s.set[:last]
+	delete(s.index, string(b))
 }
 
 // each part of symmetric difference
 type Diff struct {
 	alpha *byteSet
 	beta  *byteSet
+	// items decoded on one side and backed out from the other
+	backedOut *byteSet
 }
 
-// bktNum as a good estimation for cuckoo filter capacity
-func NewDiff(bktNum uint) *Diff {
+// capacity hints at the items of either side, decoders pass the number of
+// non-empty buckets, a diff cannot hold more items than those
+func NewDiff(capacity uint) *Diff {
 	return &Diff{
-		alpha: newByteSet(bktNum),
-		beta:  newByteSet(bktNum),
+		alpha:     newByteSet(capacity),
+		beta:      newByteSet(capacity),
+		backedOut: newByteSet(0),
 	}
 }
 
@@ -187,19 +222,32 @@ func (d Diff) BetaSlice() [][]byte {
 
 // assume b is pure bucket
 func (d *Diff) encode(b *Bucket) error {
-	cpy := make([]byte, len(b.dataSum))
-	copy(cpy, b.dataSum)
 	if b.count == 1 {
+		return d.encodeItem(b.dataSum, true)
+	}
+	if b.count == -1 {
+		return d.encodeItem(b.dataSum, false)
+	}
+	return nil
+}
+
+// encodeItem adds a copy of an item to the alpha or beta side. An item
+// already on the other side is backed out of it instead.
+func (d *Diff) encodeItem(b []byte, alpha bool) error {
+	cpy := make([]byte, len(b))
+	copy(cpy, b)
+	if alpha {
 		if d.beta.test(cpy) {
 			d.beta.delete(cpy)
-			return errors.New("repetitive bytes found in beta")
+			d.backedOut.insert(cpy)
+			return fmt.Errorf("%w in beta", ErrRepetitiveBytes)
 		}
 		d.alpha.insert(cpy)
-	}
-	if b.count == -1 {
+	} else {
 		if d.alpha.test(cpy) {
 			d.alpha.delete(cpy)
-			return errors.New("repetitive bytes found in alpha")
+			d.backedOut.insert(cpy)
+			return fmt.Errorf("%w in alpha", ErrRepetitiveBytes)
 		}
 		d.beta.insert(cpy)
 	}
@@ -213,3 +261,22 @@ func (d Diff) AlphaLen() int {
 func (d Diff) BetaLen() int {
 	return d.beta.len()
 }
+
+// Collisions is the number of false pure buckets detected and backed out
+// while decoding. The diff is still exact if decoding succeeded.
+func (d Diff) Collisions() int {
+	return d.backedOut.len()
+}
+
+// table rebuilds a table of the same parameters as t holding the diff
+func (d Diff) table(t *Table) *Table {
+	rtn := t.blank()
+	rtn.observer = nil
+	for _, b := range d.alpha.slice() {
+		rtn.Insert(b)
+	}
+	for _, b := range d.beta.slice() {
+		rtn.Delete(b)
+	}
+	return rtn
+}
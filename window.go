@@ -0,0 +1,125 @@
+package iblt
+
+import (
+	"fmt"
+	"time"
+)
+
+// WindowedTable holds the items seen during the last few epochs, one table
+// per epoch. A whole epoch expires at once, so items never have to be
+// deleted one by one to keep the window current.
+//
+// Epochs are aligned to multiples of the epoch duration since the Unix
+// epoch, so peers with roughly synchronized clocks agree on the epoch an
+// item falls into. Peers reconcile the summed Table of the same Epoch.
+type WindowedTable struct {
+	// ring of tables, epochs[epoch % len(epochs)] holds epoch
+	epochs   []*Table
+	epoch    int64
+	duration time.Duration
+	now      func() time.Time
+
+	bktNum  uint
+	dataLen int
+	hashLen int
+	hashNum int
+}
+
+// Specify number of epochs in the window, epoch duration, then table
+// parameters as in NewTable
+func NewWindowedTable(epochs int, duration time.Duration, buckets uint, dataLen int, hashLen int, hashNum int) (*WindowedTable, error) {
+	if epochs < 1 {
+		return nil, fmt.Errorf("%d epochs, want at least 1", epochs)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("epoch duration %v, want a positive one", duration)
+	}
+	w := &WindowedTable{
+		epochs:   make([]*Table, epochs),
+		duration: duration,
+		now:      time.Now,
+		bktNum:   buckets,
+		dataLen:  dataLen,
+		hashLen:  hashLen,
+		hashNum:  hashNum,
+	}
+	for i := range w.epochs {
+		w.epochs[i] = NewTable(buckets, dataLen, hashLen, hashNum)
+	}
+	w.epoch = w.epochOf(w.now())
+	return w, nil
+}
+
+func (w WindowedTable) epochOf(t time.Time) int64 {
+	ns, d := t.UnixNano(), int64(w.duration)
+	// round down before 1970 too, epoch 0 is as long as any other
+	if ns < 0 && ns%d != 0 {
+		return ns/d - 1
+	}
+	return ns / d
+}
+
+// epochs before 1970 are negative, their slots count down from the end
+func (w WindowedTable) slot(epoch int64) *Table {
+	return w.epochs[w.slotIndex(epoch)]
+}
+
+func (w WindowedTable) slotIndex(epoch int64) int64 {
+	n := int64(len(w.epochs))
+	return (epoch%n + n) % n
+}
+
+// Advance expires the epochs that fell out of the window by now. Every
+// other method advances first, calling it only releases memory earlier.
+func (w *WindowedTable) Advance() {
+	epoch := w.epochOf(w.now())
+	if epoch <= w.epoch {
+		return
+	}
+
+	steps := epoch - w.epoch
+	if steps > int64(len(w.epochs)) {
+		steps = int64(len(w.epochs))
+	}
+	for i := int64(1); i <= steps; i++ {
+		// the slot of a new epoch is the slot of the oldest one
+		w.epochs[w.slotIndex(w.epoch+i)] = NewTable(w.bktNum, w.dataLen, w.hashLen, w.hashNum)
+	}
+	w.epoch = epoch
+}
+
+// Epoch is the number of the current epoch
+func (w *WindowedTable) Epoch() int64 {
+	w.Advance()
+	return w.epoch
+}
+
+// Insert adds an item to the current epoch
+func (w *WindowedTable) Insert(d []byte) error {
+	w.Advance()
+	return w.slot(w.epoch).Insert(d)
+}
+
+// InsertAt adds an item to the epoch of its own timestamp, such as the send
+// time of a message, so that peers receiving it at different times still
+// file it under the same epoch. It fails with ErrOutsideWindow if the
+// timestamp is older than the window or later than the current epoch.
+func (w *WindowedTable) InsertAt(d []byte, t time.Time) error {
+	w.Advance()
+	epoch := w.epochOf(t)
+	if epoch > w.epoch || epoch <= w.epoch-int64(len(w.epochs)) {
+		return ErrOutsideWindow
+	}
+	return w.slot(epoch).Insert(d)
+}
+
+// Table sums the epochs of the window into a new table
+func (w *WindowedTable) Table() *Table {
+	w.Advance()
+	sum := NewTable(w.bktNum, w.dataLen, w.hashLen, w.hashNum)
+	for _, t := range w.epochs {
+		// same parameters, cannot fail
+		sum.Add(t)
+	}
+	return sum
+}
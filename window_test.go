@@ -0,0 +1,143 @@
+package iblt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func newTestWindow(t *testing.T, clock *testClock) *WindowedTable {
+	w, err := NewWindowedTable(3, time.Minute, 64, 1, 1, 3)
+	if err != nil {
+		t.Fatalf("new window error: %v", err)
+	}
+	w.now = clock.now
+	w.epoch = w.epochOf(clock.now())
+	return w
+}
+
+func decodeWindow(t *testing.T, w *WindowedTable) [][]byte {
+	diff, err := w.Table().Decode()
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	diff.Sort()
+	return diff.AlphaSlice()
+}
+
+func TestWindowedTable_Expiry(t *testing.T) {
+	clock := &testClock{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := newTestWindow(t, clock)
+
+	for _, b := range []byte{1, 2, 3} {
+		if err := w.Insert([]byte{b}); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		clock.t = clock.t.Add(time.Minute)
+	}
+	// the epoch of item 1 just expired
+	if get := decodeWindow(t, w); !reflect.DeepEqual(get, [][]byte{{2}, {3}}) {
+		t.Errorf("window want [[2] [3]], get %v", get)
+	}
+
+	if err := w.InsertAt([]byte{4}, clock.t.Add(-2*time.Minute)); err != nil {
+		t.Errorf("insert at oldest epoch error: %v", err)
+	}
+	if err := w.InsertAt([]byte{5}, clock.t.Add(-3*time.Minute)); !errors.Is(err, ErrOutsideWindow) {
+		t.Errorf("insert before window error want %v, get %v", ErrOutsideWindow, err)
+	}
+	if err := w.InsertAt([]byte{5}, clock.t.Add(time.Minute)); !errors.Is(err, ErrOutsideWindow) {
+		t.Errorf("insert after window error want %v, get %v", ErrOutsideWindow, err)
+	}
+	if get := decodeWindow(t, w); !reflect.DeepEqual(get, [][]byte{{2}, {3}, {4}}) {
+		t.Errorf("window want [[2] [3] [4]], get %v", get)
+	}
+
+	clock.t = clock.t.Add(time.Hour)
+	if get := decodeWindow(t, w); len(get) != 0 {
+		t.Errorf("window not empty after an hour, get %v", get)
+	}
+}
+
+func TestWindowedTable_Reconcile(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 30, 0, time.UTC)
+	aliceClock := &testClock{start}
+	bobClock := &testClock{start}
+	alice := newTestWindow(t, aliceClock)
+	bob := newTestWindow(t, bobClock)
+
+	// both see the same messages, bob a little later and one epoch later
+	// for some, and alice one more message
+	for i := byte(0); i < 20; i++ {
+		sent := start.Add(time.Duration(i) * 5 * time.Second)
+		aliceClock.t = sent.Add(time.Second)
+		bobClock.t = sent.Add(40 * time.Second)
+		if err := alice.InsertAt([]byte{i}, sent); err != nil {
+			t.Fatalf("alice insert error: %v", err)
+		}
+		if err := bob.InsertAt([]byte{i}, sent); err != nil {
+			t.Fatalf("bob insert error: %v", err)
+		}
+	}
+	if err := alice.Insert([]byte{100}); err != nil {
+		t.Fatalf("alice insert error: %v", err)
+	}
+
+	aliceClock.t = bobClock.t
+	if alice.Epoch() != bob.Epoch() {
+		t.Fatalf("epochs differ %d, %d", alice.Epoch(), bob.Epoch())
+	}
+	table := alice.Table()
+	if err := table.Subtract(bob.Table()); err != nil {
+		t.Fatalf("subtract error: %v", err)
+	}
+	diff, err := table.Decode()
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if !reflect.DeepEqual(diff.AlphaSlice(), [][]byte{{100}}) || diff.BetaLen() != 0 {
+		t.Errorf("diff want [[100]] [], get %v %v", diff.AlphaSlice(), diff.BetaSlice())
+	}
+}
+
+func TestNewWindowedTable(t *testing.T) {
+	for _, c := range []struct {
+		epochs   int
+		duration time.Duration
+	}{
+		{0, time.Minute},
+		{-1, time.Minute},
+		{3, 0},
+		{3, -time.Minute},
+	} {
+		if _, err := NewWindowedTable(c.epochs, c.duration, 64, 1, 1, 3); err == nil {
+			t.Errorf("%d epochs of %v accepted", c.epochs, c.duration)
+		}
+	}
+
+	// epochs before 1970 are negative
+	clock := &testClock{time.Unix(-90, 0)}
+	w := newTestWindow(t, clock)
+	if w.Epoch() != -2 {
+		t.Errorf("epoch want -2, get %d", w.Epoch())
+	}
+	if err := w.Insert([]byte{1}); err != nil {
+		t.Fatalf("insert error: %v", err)
+	}
+	clock.t = clock.t.Add(time.Minute)
+	if err := w.InsertAt([]byte{2}, time.Unix(-90, 0)); err != nil {
+		t.Fatalf("insert error: %v", err)
+	}
+	if got := decodeWindow(t, w); !reflect.DeepEqual(got, [][]byte{{1}, {2}}) {
+		t.Errorf("window want [1 2], get %v", got)
+	}
+}
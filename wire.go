@@ -0,0 +1,366 @@
+package iblt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	"github.com/dchest/siphash"
+)
+
+// A serialized table is framed as
+//
+//	magic           4 bytes "IBLT"
+//	version         1 byte
+//	hash algorithm  1 byte
+//	key fingerprint 4 bytes
+//	cell mode       1 byte
+//	buckets         4 bytes
+//	data length     2 bytes
+//	checksum bits   2 bytes
+//	count bits      1 byte, 0 for unbounded counts
+//	hash functions  2 bytes
+//	cells
+//	CRC32C          4 bytes of everything before
+//
+// in big endian. Anything not starting with the magic is read as the legacy
+// format of SerializeLegacy.
+const (
+	frameMagic   = "IBLT"
+	frameVersion = 1
+	frameHeader  = 22
+	frameTrailer = 4
+
+	// SipHash-2-4 keyed with key0 and key1
+	hashSipHash24 = 1
+
+	// the most buckets Deserialize allocates for cells that do not take
+	// space in proportion to the buckets, sparse or compressed
+	maxFrameBuckets = 1 << 24
+)
+
+// cell modes
+const (
+	// non-empty buckets only, each as the uvarint gap to the previous one,
+	// the varint count, data and checksum
+	cellsSparse = 0
+	// every bucket bit packed as packedCells writes them
+	cellsPacked = 1
+	// an occupancy bitmap of one bit a bucket, most significant first, then
+	// the non-empty buckets as in cellsSparse without the gap
+	cellsBitmap = 2
+	// a codec ID, then the cells of columnarCells compressed by that codec,
+	// or as they are for ID 0
+	cellsColumnar = 3
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// keyFingerprint tells peers hashing with different keys apart
+func keyFingerprint() uint32 {
+	return uint32(siphash.Hash(key0, key1, []byte(frameMagic)) >> 32)
+}
+
+// Serialize writes t in the framed format, self describing and checked by
+// a CRC32C, see SerializeLegacy for peers of the first releases. The cells
+// are written in whichever mode takes the fewest bytes, unless the options
+// ask for columns.
+func (t Table) Serialize(opts ...SerializeOption) ([]byte, error) {
+	cfg := &serializeConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if uint64(t.bktNum) > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: %d buckets in a frame", ErrFormatLimit, t.bktNum)
+	}
+	if t.dataLen > math.MaxUint16 || t.hashBits > math.MaxUint16 || t.hashNum > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: %d bytes of data, %d checksum bits and %d hash functions in a frame", ErrFormatLimit,
+			t.dataLen, t.hashBits, t.hashNum)
+	}
+
+	var cells []byte
+	mode := t.cellMode()
+	switch {
+	case cfg.columnar:
+		if cfg.codec != nil && t.bktNum > maxFrameBuckets {
+			return nil, fmt.Errorf("%w: %d buckets compressed, at most %d", ErrFormatLimit, t.bktNum, maxFrameBuckets)
+		}
+		var err error
+		if cells, err = t.columnarCells(cfg.codec); err != nil {
+			return nil, err
+		}
+		mode = cellsColumnar
+	case mode == cellsSparse:
+		cells = t.sparseCells()
+	case mode == cellsPacked:
+		cells = t.packedCells()
+	case mode == cellsBitmap:
+		cells = t.bitmapCells()
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, frameHeader+frameTrailer))
+	buffer.WriteString(frameMagic)
+	buffer.WriteByte(frameVersion)
+	buffer.WriteByte(hashSipHash24)
+	buffer.Write(binary.BigEndian.AppendUint32(nil, keyFingerprint()))
+	buffer.WriteByte(mode)
+	buffer.Write(binary.BigEndian.AppendUint32(nil, uint32(t.bktNum)))
+	buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(t.dataLen)))
+	buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(t.hashBits)))
+	buffer.WriteByte(byte(t.countBits))
+	buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(t.hashNum)))
+
+	buffer.Write(cells)
+	buffer.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(buffer.Bytes(), castagnoli)))
+	return buffer.Bytes(), nil
+}
+
+// cellMode picks the smallest encoding of the cells of t. Sparse cells win
+// while few buckets are occupied, a bitmap costs less once the gaps take
+// more than a bit a bucket, and packing wins for well filled packed tables.
+func (t Table) cellMode() byte {
+	var occupied, gaps, counts int
+	next := 0
+	for idx, bkt := range t.buckets {
+		if bkt == nil || bkt.empty() {
+			continue
+		}
+		occupied++
+		gaps += uvarintLen(uint64(idx - next))
+		counts += varintLen(int64(bkt.count))
+		next = idx + 1
+	}
+	cell := occupied*(t.dataLen+(t.hashBits+7)/8) + counts
+
+	mode, size := byte(cellsSparse), gaps+cell
+	// sparse cells of more buckets are not read back
+	if bitmap := (len(t.buckets)+7)/8 + cell; bitmap < size || len(t.buckets) > maxFrameBuckets {
+		mode, size = cellsBitmap, bitmap
+	}
+	if t.packed() {
+		bits := t.dataLen*8 + t.hashBits + t.countBits
+		if packed := (len(t.buckets)*bits + 7) / 8; packed <= size {
+			mode = cellsPacked
+		}
+	}
+	return mode
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+func varintLen(v int64) int {
+	u := uint64(v) << 1
+	if v < 0 {
+		u = ^u
+	}
+	return uvarintLen(u)
+}
+
+func (t Table) sparseCells() []byte {
+	var rtn []byte
+	next := 0
+	for idx, bkt := range t.buckets {
+		if bkt == nil || bkt.empty() {
+			continue
+		}
+		rtn = binary.AppendUvarint(rtn, uint64(idx-next))
+		rtn = binary.AppendVarint(rtn, int64(bkt.count))
+		rtn = append(rtn, bkt.dataSum...)
+		rtn = append(rtn, bkt.hashSum...)
+		next = idx + 1
+	}
+	return rtn
+}
+
+func (t Table) bitmapCells() []byte {
+	rtn := make([]byte, (len(t.buckets)+7)/8)
+	for idx, bkt := range t.buckets {
+		if bkt == nil || bkt.empty() {
+			continue
+		}
+		rtn[idx/8] |= 0x80 >> (idx % 8)
+		rtn = binary.AppendVarint(rtn, int64(bkt.count))
+		rtn = append(rtn, bkt.dataSum...)
+		rtn = append(rtn, bkt.hashSum...)
+	}
+	return rtn
+}
+
+// readBitmapCells fills the empty table t with what bitmapCells wrote
+func (t *Table) readBitmapCells(b []byte) error {
+	hashLen := (t.hashBits + 7) / 8
+	size := (len(t.buckets) + 7) / 8
+	if len(b) < size {
+		return ErrCorrupt
+	}
+	bitmap, b := b[:size], b[size:]
+	for idx := range bitmap {
+		occupied := bitmap[idx]
+		if idx == size-1 && len(t.buckets)%8 != 0 && occupied<<(len(t.buckets)%8) != 0 {
+			// bits past the last bucket
+			return ErrCorrupt
+		}
+		for bit := 0; occupied != 0; bit++ {
+			if occupied&(0x80>>bit) == 0 {
+				continue
+			}
+			occupied &^= 0x80 >> bit
+
+			count, n := binary.Varint(b)
+			if n <= 0 || len(b[n:]) < t.dataLen+hashLen {
+				return ErrCorrupt
+			}
+			b = b[n:]
+			bkt := t.newBucket()
+			bkt.count = int(count)
+			bkt.wrap()
+			copy(bkt.dataSum, b[:t.dataLen])
+			copy(bkt.hashSum, b[t.dataLen:t.dataLen+hashLen])
+			b = b[t.dataLen+hashLen:]
+			t.buckets[idx*8+bit] = bkt
+		}
+	}
+	if len(b) > 0 {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// readSparseCells fills the empty table t with what sparseCells wrote
+func (t *Table) readSparseCells(b []byte) error {
+	hashLen := (t.hashBits + 7) / 8
+	next := uint64(0)
+	for len(b) > 0 {
+		gap, n := binary.Uvarint(b)
+		if n <= 0 {
+			return ErrCorrupt
+		}
+		b = b[n:]
+		count, n := binary.Varint(b)
+		if n <= 0 {
+			return ErrCorrupt
+		}
+		b = b[n:]
+		idx := next + gap
+		if idx < next || idx >= uint64(t.bktNum) || len(b) < t.dataLen+hashLen {
+			return ErrCorrupt
+		}
+
+		bkt := t.newBucket()
+		bkt.count = int(count)
+		bkt.wrap()
+		copy(bkt.dataSum, b[:t.dataLen])
+		copy(bkt.hashSum, b[t.dataLen:t.dataLen+hashLen])
+		b = b[t.dataLen+hashLen:]
+		t.buckets[idx] = bkt
+		next = idx + 1
+	}
+	return nil
+}
+
+// Deserialize reads a table written by Serialize, or by SerializeLegacy.
+// A framed table fails with ErrCorrupt if it is truncated or its checksum
+// mismatches, and with ErrUnsupportedFormat if it was written by a later
+// version or with another hash function. Parameters no constructor accepts
+// fail with ErrCorrupt, as do sparse or compressed cells of more than 2^24
+// buckets, which would be allocated before the cells prove them.
+func Deserialize(b []byte) (*Table, error) {
+	if !bytes.HasPrefix(b, []byte(frameMagic)) {
+		return deserializeLegacy(b)
+	}
+
+	if len(b) < frameHeader+frameTrailer {
+		return nil, ErrCorrupt
+	}
+	body, sum := b[:len(b)-frameTrailer], b[len(b)-frameTrailer:]
+	if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(sum) {
+		return nil, ErrCorrupt
+	}
+
+	if version := body[4]; version != frameVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedFormat, version)
+	}
+	if algorithm := body[5]; algorithm != hashSipHash24 {
+		return nil, fmt.Errorf("%w: hash algorithm %d", ErrUnsupportedFormat, algorithm)
+	}
+	if fp := binary.BigEndian.Uint32(body[6:]); fp != keyFingerprint() {
+		return nil, &ParamMismatchError{"key fingerprint", int(keyFingerprint()), int(fp)}
+	}
+	mode := body[10]
+	bktNum := uint(binary.BigEndian.Uint32(body[11:]))
+	dataLen := int(binary.BigEndian.Uint16(body[15:]))
+	hashBits := int(binary.BigEndian.Uint16(body[17:]))
+	countBits := int(body[19])
+	hashNum := int(binary.BigEndian.Uint16(body[20:]))
+	if err := checkShape(bktNum, hashNum); err != nil {
+		return nil, err
+	}
+	if hashBits < 1 || hashBits > maxHashBits || countBits == 0 && hashBits%8 != 0 {
+		return nil, ErrCorrupt
+	}
+
+	// the buckets are allocated before the cells are read, a frame must not
+	// claim more buckets than its cells can describe
+	cells := body[frameHeader:]
+	switch mode {
+	case cellsSparse:
+		if bktNum > maxFrameBuckets {
+			return nil, ErrCorrupt
+		}
+	case cellsPacked:
+		cellBits := uint64(countBits + dataLen*8 + hashBits)
+		if countBits == 0 || uint64(len(cells)) != (uint64(bktNum)*cellBits+7)/8 {
+			return nil, ErrCorrupt
+		}
+	case cellsBitmap:
+		if uint64(len(cells))*8 < uint64(bktNum) {
+			return nil, ErrCorrupt
+		}
+	case cellsColumnar:
+		compressed := len(cells) > 0 && cells[0] != 0
+		if compressed && bktNum > maxFrameBuckets || !compressed && uint64(len(cells))*8 < uint64(bktNum) {
+			return nil, ErrCorrupt
+		}
+	default:
+		return nil, fmt.Errorf("%w: cell mode %d", ErrUnsupportedFormat, mode)
+	}
+
+	var table *Table
+	if countBits > 0 {
+		var err error
+		if table, err = NewPackedTable(bktNum, dataLen, hashBits, countBits, hashNum); err != nil {
+			return nil, ErrCorrupt
+		}
+	} else {
+		table = NewTable(bktNum, dataLen, hashBits/8, hashNum)
+	}
+
+	switch mode {
+	case cellsSparse:
+		if err := table.readSparseCells(cells); err != nil {
+			return nil, err
+		}
+	case cellsPacked:
+		if err := table.readPackedCells(cells); err != nil {
+			return nil, err
+		}
+	case cellsBitmap:
+		if err := table.readBitmapCells(cells); err != nil {
+			return nil, err
+		}
+	case cellsColumnar:
+		if err := table.readColumnarCells(cells); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,273 @@
+package iblt
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+func TestSerializeFrame(t *testing.T) {
+	// more buckets than the legacy format can index
+	table := NewTable(100000, 8, 2, 4)
+	b := make([]byte, 8)
+	for i := 0; i < 3000; i++ {
+		testRand(t).Read(b)
+		if i%3 == 0 {
+			table.Delete(b)
+		} else {
+			table.Insert(b)
+		}
+	}
+	ser, err := table.Serialize()
+	if err != nil {
+		t.Fatalf("serialize error: %v", err)
+	}
+	if string(ser[:4]) != frameMagic {
+		t.Fatalf("frame starts with %q", ser[:4])
+	}
+	got, err := Deserialize(ser)
+	if err != nil {
+		t.Fatalf("deserialize error: %v", err)
+	}
+	if !table.equal(got) {
+		t.Error("deserialized table mismatches")
+	}
+}
+
+func TestDeserializeLegacy(t *testing.T) {
+	// written by the first releases, 8 buckets of 2 byte items, {ab cd}
+	// inserted and {12 34} deleted
+	legacy := []byte{
+		0x0, 0x8, 0x0, 0x2, 0x0, 0x1, 0x0, 0x2,
+		0x0, 0x1, 0x0, 0x1, 0xab, 0xcd, 0x5c,
+		0x0, 0x3, 0x0, 0x0, 0xb9, 0xf9, 0x2a,
+		0x0, 0x5, 0xff, 0xff, 0x12, 0x34, 0x76,
+	}
+	want := NewTable(8, 2, 1, 2)
+	want.Insert([]byte{0xab, 0xcd})
+	want.Delete([]byte{0x12, 0x34})
+
+	got, err := Deserialize(legacy)
+	if err != nil {
+		t.Fatalf("deserialize error: %v", err)
+	}
+	if !want.equal(got) {
+		t.Error("legacy table mismatches")
+	}
+	if b, _ := want.SerializeLegacy(); string(b) != string(legacy) {
+		t.Errorf("legacy serialization changed: %x", b)
+	}
+
+	outside := append([]byte{}, legacy...)
+	outside[9] = 8
+	for _, c := range []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{1}},
+		{"short magic", []byte("IBL")},
+		{"short header", legacy[:7]},
+		{"truncated cell", legacy[:len(legacy)-1]},
+		{"bucket outside the table", outside},
+		{"no buckets", []byte{0, 0, 0, 2, 0, 1, 0, 1}},
+		{"no hash functions", []byte{0, 8, 0, 2, 0, 1, 0, 0}},
+		{"more hash functions than buckets", []byte{0, 1, 0, 1, 0, 1, 0, 2}},
+		{"no checksum", []byte{0, 8, 0, 2, 0, 0, 0, 2}},
+		{"checksum too long", []byte{0, 8, 0, 2, 0, 9, 0, 2}},
+		{"packed without count width", []byte{0, 8, 0, 2, 0x80, 4, 0, 2}},
+	} {
+		if _, err := Deserialize(c.b); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: error want %v, get %v", c.name, ErrCorrupt, err)
+		}
+	}
+}
+
+func TestSerializeLegacyLimits(t *testing.T) {
+	if _, err := NewTable(1<<16, 2, 1, 2).SerializeLegacy(); !errors.Is(err, ErrFormatLimit) {
+		t.Error("65536 buckets serialized in the legacy format")
+	}
+	table := NewTable(8, 2, 1, 2)
+	for i := 0; i < 1<<15; i++ {
+		table.Insert([]byte{1, 2})
+	}
+	if _, err := table.SerializeLegacy(); !errors.Is(err, ErrFormatLimit) {
+		t.Error("count 32768 serialized in the legacy format")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("9 byte checksum does not panic")
+		}
+	}()
+	NewTable(8, 1, 9, 2)
+}
+
+func TestSerializeLimits(t *testing.T) {
+	table := NewTable(8, 1<<16, 1, 2)
+	table.Insert(make([]byte, 1<<16))
+	if _, err := table.Serialize(); !errors.Is(err, ErrFormatLimit) {
+		t.Error("65536 byte items serialized")
+	}
+	if _, err := NewTable(1<<16, 1, 1, 1<<16).Serialize(); !errors.Is(err, ErrFormatLimit) {
+		t.Error("65536 hash functions serialized")
+	}
+}
+
+func TestDeserializeFrameErrors(t *testing.T) {
+	table := NewTable(64, 4, 1, 3)
+	table.Insert([]byte{1, 2, 3, 4})
+	ser, _ := table.Serialize()
+
+	edit := func(off int, v byte) []byte {
+		return reframe(ser, func(b []byte) { b[off] = v })
+	}
+	flipped := append([]byte{}, ser...)
+	flipped[frameHeader] ^= 1
+
+	for _, c := range []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"truncated", ser[:len(ser)-1], ErrCorrupt},
+		{"header only", ser[:frameHeader], ErrCorrupt},
+		{"flipped bit", flipped, ErrCorrupt},
+		{"version", edit(4, frameVersion+1), ErrUnsupportedFormat},
+		{"hash algorithm", edit(5, 9), ErrUnsupportedFormat},
+		{"key fingerprint", edit(6, ser[6]^1), ErrParamMismatch},
+		{"cell mode", edit(10, 7), ErrUnsupportedFormat},
+		{"packed cells of a table with counts", edit(10, cellsPacked), ErrCorrupt},
+		{"no checksum", edit(18, 0), ErrCorrupt},
+		{"checksum too long", edit(18, 72), ErrCorrupt},
+		{"no hash functions", edit(21, 0), ErrCorrupt},
+		{"too many sparse buckets", edit(11, 0xff), ErrCorrupt},
+	} {
+		if _, err := Deserialize(c.b); !errors.Is(err, c.want) {
+			t.Errorf("%s: error want %v, get %v", c.name, c.want, err)
+		}
+	}
+}
+
+// reframe rewrites the header or cells of a frame and fixes its checksum up
+func reframe(ser []byte, edit func(b []byte)) []byte {
+	b := append([]byte{}, ser...)
+	edit(b)
+	binary.BigEndian.PutUint32(b[len(b)-frameTrailer:], crc32.Checksum(b[:len(b)-frameTrailer], castagnoli))
+	return b
+}
+
+func TestDeserializeFrameBuckets(t *testing.T) {
+	table := NewTable(64, 4, 1, 3)
+	packed, _ := NewPackedTable(64, 4, 4, 3, 3)
+	b := make([]byte, 4)
+	r := testRand(t)
+	for i := 0; i < 60; i++ {
+		r.Read(b)
+		table.Insert(b)
+		packed.Insert(b)
+	}
+
+	// more buckets than the cells cover must fail before they are allocated
+	for _, c := range []struct {
+		name  string
+		table *Table
+		opts  []SerializeOption
+		mode  byte
+	}{
+		{"bitmap", table, nil, cellsBitmap},
+		{"packed", packed, nil, cellsPacked},
+		{"columns", table, []SerializeOption{WithColumns()}, cellsColumnar},
+		{"compressed", table, []SerializeOption{WithCodec(Flate)}, cellsColumnar},
+	} {
+		ser, err := c.table.Serialize(c.opts...)
+		if err != nil {
+			t.Fatalf("%s: serialize error: %v", c.name, err)
+		}
+		if ser[10] != c.mode {
+			t.Fatalf("%s: cell mode want %d, get %d", c.name, c.mode, ser[10])
+		}
+		huge := reframe(ser, func(b []byte) { binary.BigEndian.PutUint32(b[11:], 1<<31) })
+		if _, err := Deserialize(huge); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: error want %v, get %v", c.name, ErrCorrupt, err)
+		}
+	}
+
+	if _, err := NewTable(maxFrameBuckets+1, 1, 1, 2).Serialize(WithCodec(Flate)); !errors.Is(err, ErrFormatLimit) {
+		t.Error("compressed more buckets than are read back")
+	}
+}
+
+func TestSerializeCellModes(t *testing.T) {
+	packed, _ := NewPackedTable(1000, 8, 4, 3, 3)
+	for _, c := range []struct {
+		name  string
+		table *Table
+		items int
+		mode  byte
+	}{
+		{"few items", NewTable(1000, 8, 1, 3), 20, cellsSparse},
+		{"many items", NewTable(1000, 8, 1, 3), 300, cellsBitmap},
+		{"few packed items", packed.blank(), 20, cellsSparse},
+		{"many packed items", packed.blank(), 1000, cellsPacked},
+	} {
+		b := make([]byte, 8)
+		r := testRand(t)
+		for i := 0; i < c.items; i++ {
+			r.Read(b)
+			c.table.Insert(b)
+		}
+		ser, err := c.table.Serialize()
+		if err != nil {
+			t.Fatalf("%s: serialize error: %v", c.name, err)
+		}
+		if mode := ser[10]; mode != c.mode {
+			t.Errorf("%s: cell mode want %d, get %d", c.name, c.mode, mode)
+		}
+
+		// every mode reads back, the chosen one is the smallest
+		sizes := map[byte]int{
+			cellsSparse: len(c.table.sparseCells()),
+			cellsBitmap: len(c.table.bitmapCells()),
+		}
+		if c.table.packed() {
+			sizes[cellsPacked] = len(c.table.packedCells())
+		}
+		for mode, size := range sizes {
+			if size < len(ser)-frameHeader-frameTrailer {
+				t.Errorf("%s: cell mode %d takes %d bytes, fewer than %d", c.name, mode, size, len(ser)-frameHeader-frameTrailer)
+			}
+		}
+		got, err := Deserialize(ser)
+		if err != nil {
+			t.Fatalf("%s: deserialize error: %v", c.name, err)
+		}
+		if !c.table.equal(got) {
+			t.Errorf("%s: deserialized table mismatches", c.name)
+		}
+	}
+}
+
+func TestReadBitmapCells(t *testing.T) {
+	table := NewTable(10, 2, 1, 2)
+	table.Insert([]byte{1, 2})
+	cells := table.bitmapCells()
+	if err := table.blank().readBitmapCells(cells); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+
+	for _, c := range []struct {
+		name string
+		b    []byte
+	}{
+		{"bit past the last bucket", append([]byte{cells[0], cells[1] | 1}, cells[2:]...)},
+		{"missing cell", cells[:len(cells)-1]},
+		{"trailing bytes", append(append([]byte{}, cells...), 0)},
+		{"short bitmap", cells[:1]},
+	} {
+		if err := table.blank().readBitmapCells(c.b); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: error want %v, get %v", c.name, ErrCorrupt, err)
+		}
+	}
+}